@@ -1,13 +1,14 @@
 module github.com/mishudark/kitten
 
-go 1.12
+go 1.16
 
 require (
 	contrib.go.opencensus.io/exporter/prometheus v0.1.0
-	github.com/fatih/structs v1.1.0
+	github.com/fatih/structs v1.1.0 // indirect
 	github.com/go-kit/kit v0.9.0
 	github.com/go-ozzo/ozzo-validation v3.6.0+incompatible
 	github.com/google/go-cmp v0.3.1
+	github.com/lib/pq v1.1.1 // indirect
 	github.com/mishudark/errors v0.0.0-20190221111348-b16f7e94bb58
 	go.opencensus.io v0.22.0
 	upper.io/db.v3 v3.5.7+incompatible
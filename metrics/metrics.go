@@ -18,11 +18,35 @@ var (
 
 	// Errors encounters the number of errors
 	Errors = stats.Int64("grpc/errors", "The number of errors encountered", "1")
+
+	// TxRetries counts the number of times a transaction is retried
+	TxRetries = stats.Int64("db/tx_retries", "The number of retried transactions", "1")
+
+	// DBLatencyMs is the latency of the database operations in milliseconds
+	DBLatencyMs = stats.Float64("db/latency", "The latency of the database operations in milliseconds", "ms")
+
+	// DBErrors counts the database operations that failed
+	DBErrors = stats.Int64("db/errors", "The number of failed database operations", "1")
+
+	// CollectionCacheHits counts the collections found in the cache
+	CollectionCacheHits = stats.Int64("db/collection_cache_hits", "The number of collections found in the cache", "1")
+
+	// CollectionCacheMisses counts the collections whose existence is checked in the database
+	CollectionCacheMisses = stats.Int64("db/collection_cache_misses", "The number of collections not found in the cache", "1")
 )
 
 // KeyMethod has a content "method"
 var KeyMethod, _ = tag.NewKey("method") // nolint: errcheck
 
+// KeySQLState has the SQLSTATE code of the error that caused a retry
+var KeySQLState, _ = tag.NewKey("sqlstate") // nolint: errcheck
+
+// KeyTable has the table of a database operation
+var KeyTable, _ = tag.NewKey("table") // nolint: errcheck
+
+// KeyOperation has the name of a database operation, e.g. insert
+var KeyOperation, _ = tag.NewKey("operation") // nolint: errcheck
+
 var (
 	// LatencyView is the latency in ms
 	LatencyView = &view.View{
@@ -50,6 +74,54 @@ var (
 		Description: "The number of errors encountered",
 		Aggregation: view.Count(),
 	}
+
+	// TxRetriesCountView the number of retried transactions by SQLSTATE code
+	TxRetriesCountView = &view.View{
+		Name:        "db/tx_retries",
+		Measure:     TxRetries,
+		Description: "The number of retried transactions",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeySQLState},
+	}
+
+	// DBLatencyView is the latency in ms of the database operations by table and operation
+	DBLatencyView = &view.View{
+		Name:        "db/latency",
+		Measure:     DBLatencyMs,
+		Description: "The distribution of the latencies of the database operations",
+
+		// Latency in buckets:
+		// [>=0ms, >=1ms, >=2ms, >=5ms, >=10ms, >=25ms, >=50ms, >=100ms, >=250ms, >=500ms, >=1s, >=2.5s, >=5s]
+		Aggregation: view.Distribution(0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000),
+		TagKeys:     []tag.Key{KeyTable, KeyOperation},
+	}
+
+	// DBErrorCountView the number of failed database operations by table and operation
+	DBErrorCountView = &view.View{
+		Name:        "db/errors",
+		Measure:     DBErrors,
+		Description: "The number of failed database operations",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyTable, KeyOperation},
+	}
+
+	// CollectionCacheHitsCountView the number of collection cache hits by table
+	CollectionCacheHitsCountView = &view.View{
+		Name:        "db/collection_cache_hits",
+		Measure:     CollectionCacheHits,
+		Description: "The number of collections found in the cache",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyTable},
+	}
+
+	// CollectionCacheMissesCountView the number of collection cache misses by table
+	CollectionCacheMissesCountView = &view.View{
+		Name:        "db/collection_cache_misses",
+		Measure:     CollectionCacheMisses,
+		Description: "The number of collections not found in the cache",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyTable},
+	}
 )
 
 // NewPrometheusExporter returns a prometheus exporter based on the previous
@@ -57,7 +129,10 @@ var (
 func NewPrometheusExporter(namespace string) *prometheus.Exporter {
 	// Register the views, it is imperative that this step exists
 	// lest recorded metrics will be dropped and never exported.
-	if err := view.Register(LatencyView, HitsCountView, ErrorCountView); err != nil {
+	if err := view.Register(
+		LatencyView, HitsCountView, ErrorCountView, TxRetriesCountView,
+		DBLatencyView, DBErrorCountView, CollectionCacheHitsCountView, CollectionCacheMissesCountView,
+	); err != nil {
 		log.Fatalf("Failed to register the views: %v", err)
 	}
 
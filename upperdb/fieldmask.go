@@ -0,0 +1,327 @@
+package upperdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+)
+
+// jsonbPath is a field mask path that points inside a JSONB column, e.g. Settings.Theme
+// where Settings is a field stored in a JSONB column, and Theme is a field of it
+type jsonbPath struct {
+	field string
+	// segments are the struct field names or map keys used to read the value
+	segments []string
+	// keys are the json keys of the path inside the column
+	keys []string
+}
+
+// parseFieldMask splits a field mask in top level fields and JSONB paths, a path that
+// does not exist in the struct provided with Values is returned as errors.Invalid
+func (p *PartialMutation) parseFieldMask(fieldMask []string) (fields []string, paths []jsonbPath, err error) {
+	for _, path := range fieldMask {
+		if _, ok := p.fields[path]; ok {
+			fields = append(fields, path)
+			continue
+		}
+
+		jsonPath, ok := p.resolveJSONBPath(path)
+		if !ok {
+			return nil, nil, errors.E(errors.Errorf("invalid field mask, unknown path %s", path), errors.Invalid)
+		}
+
+		paths = append(paths, jsonPath)
+	}
+
+	return fields, paths, nil
+}
+
+// readColumns resolves the columns selected by a read mask, every column when it is empty or
+// it has the * wildcard, the path of an inline struct (e.g. Metadata) selects all its fields,
+// and a path inside a JSONB column selects the whole column
+func (p *PartialMutation) readColumns(readMask []string) ([]interface{}, error) {
+	var names []string
+	for _, path := range readMask {
+		if path == "*" {
+			return nil, nil
+		}
+
+		if _, ok := p.fields[path]; ok {
+			names = append(names, path)
+			continue
+		}
+
+		var nested []string
+		for name := range p.fields {
+			if strings.HasPrefix(name, path+".") {
+				nested = append(nested, name)
+			}
+		}
+
+		if len(nested) > 0 {
+			sort.Strings(nested)
+			names = append(names, nested...)
+			continue
+		}
+
+		jsonPath, ok := p.resolveJSONBPath(path)
+		if !ok {
+			return nil, errors.E(errors.Errorf("invalid read mask, unknown path %s", path), errors.Invalid)
+		}
+
+		names = append(names, jsonPath.field)
+	}
+
+	seen := make(map[string]bool)
+	var columns []interface{}
+	for _, name := range names {
+		column := p.fieldsMap[name]
+		if seen[column] {
+			continue
+		}
+
+		seen[column] = true
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+// resolveJSONBPath finds the longest prefix of path that is a field, the rest of the path
+// is resolved inside the field type by struct field name, json name or map key
+func (p *PartialMutation) resolveJSONBPath(path string) (jsonbPath, bool) {
+	segments := strings.Split(path, ".")
+	for i := len(segments) - 1; i > 0; i-- {
+		field, ok := p.fields[strings.Join(segments[:i], ".")]
+		if !ok {
+			continue
+		}
+
+		jsonPath := jsonbPath{field: field.name}
+		t := field.typ
+		for _, segment := range segments[i:] {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+
+			switch t.Kind() {
+			case reflect.Struct:
+				f, key, ok := jsonField(t, segment)
+				if !ok {
+					return jsonbPath{}, false
+				}
+
+				jsonPath.segments = append(jsonPath.segments, f.Name)
+				jsonPath.keys = append(jsonPath.keys, key)
+				t = f.Type
+			case reflect.Map:
+				if t.Key().Kind() != reflect.String {
+					return jsonbPath{}, false
+				}
+
+				jsonPath.segments = append(jsonPath.segments, segment)
+				jsonPath.keys = append(jsonPath.keys, segment)
+				t = t.Elem()
+			default:
+				return jsonbPath{}, false
+			}
+		}
+
+		return jsonPath, true
+	}
+
+	return jsonbPath{}, false
+}
+
+// allowedJSONBPaths keeps the paths whose field is allowed by the update rules
+func allowedJSONBPaths(paths []jsonbPath, includeFields, excludeFields []string) []jsonbPath {
+	rules := make(map[string]bool)
+	fields := excludeFields
+	if len(includeFields) > 0 {
+		fields = includeFields
+	}
+
+	for _, field := range fields {
+		rules[field] = true
+	}
+
+	var allowed []jsonbPath
+	for _, path := range paths {
+		if rules[path.field] == (len(includeFields) > 0) {
+			allowed = append(allowed, path)
+		}
+	}
+
+	return allowed
+}
+
+// jsonField finds a field of t by its name or by its json name, and returns the json
+// key used to serialize it
+func jsonField(t reflect.Type, name string) (reflect.StructField, string, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+
+		key := f.Name
+		if tag != "" {
+			key = tag
+		}
+
+		if f.Name == name || key == name {
+			return f, key, true
+		}
+	}
+
+	return reflect.StructField{}, "", false
+}
+
+// jsonbValue reads the value pointed by the path segments, missing map keys and nil
+// pointers are returned as nil
+func jsonbValue(v reflect.Value, segments []string) interface{} {
+	for _, segment := range segments {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil
+			}
+
+			v = v.Elem()
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			v = v.FieldByName(segment)
+		case reflect.Map:
+			v = v.MapIndex(reflect.ValueOf(segment).Convert(v.Type().Key()))
+			if !v.IsValid() {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+
+	return v.Interface()
+}
+
+// jsonbColumnsValues builds a jsonb_set expression for each column with masked paths, so only
+// the masked keys of the column are changed, columns that are updated as a whole are skipped,
+// as the paths inside another masked path. jsonb_set does nothing when the parent of the key is
+// missing, so the column and the parents of every path are set to an empty object first when
+// they are not objects, e.g. when the column is NULL
+func (p *PartialMutation) jsonbColumnsValues(structPtr interface{}, paths []jsonbPath, skip []string) (columns []string, values []interface{}, err error) {
+	skipColumns := make(map[string]bool)
+	for _, column := range skip {
+		skipColumns[column] = true
+	}
+
+	mapValues, err := p.fieldValues(structPtr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columnPaths := make(map[string][]jsonbPath)
+	for _, path := range paths {
+		column := p.fieldsMap[path.field]
+		if skipColumns[column] || hasParentPath(path, paths) {
+			continue
+		}
+
+		if _, ok := columnPaths[column]; !ok {
+			columns = append(columns, column)
+		}
+
+		columnPaths[column] = append(columnPaths[column], path)
+	}
+
+	for _, column := range columns {
+		source := quoteIdentifier(column)
+		expr := jsonbObject(source)
+
+		var args []interface{}
+		for _, parent := range parentKeys(columnPaths[column]) {
+			keys := textArray(parent)
+			expr = fmt.Sprintf("jsonb_set(%s, ?::text[], %s)", expr, jsonbObject(source+" #> ?::text[]"))
+			args = append(args, keys, keys, keys)
+		}
+
+		for _, path := range columnPaths[column] {
+			value, err := json.Marshal(jsonbValue(reflect.ValueOf(mapValues[path.field]), path.segments))
+			if err != nil {
+				return nil, nil, errors.E(err, fmt.Sprintf("invalid value for path %s.%s", path.field, strings.Join(path.segments, ".")), errors.Invalid)
+			}
+
+			expr = fmt.Sprintf("jsonb_set(%s, ?::text[], ?::jsonb)", expr)
+			args = append(args, textArray(path.keys), string(value))
+		}
+
+		values = append(values, db.Raw(expr, args...))
+	}
+
+	return columns, values, nil
+}
+
+// jsonbObject returns the given jsonb expression when it is an object, otherwise an empty object
+func jsonbObject(expr string) string {
+	return fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'object' THEN %s ELSE '{}'::jsonb END", expr, expr)
+}
+
+// hasParentPath reports if another path of the same field contains the given path
+func hasParentPath(path jsonbPath, paths []jsonbPath) bool {
+	for _, other := range paths {
+		if other.field == path.field && len(other.keys) < len(path.keys) && textArray(other.keys) == textArray(path.keys[:len(other.keys)]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parentKeys returns the keys of the parents of the paths, the shallower parents first
+func parentKeys(paths []jsonbPath) [][]string {
+	var (
+		parents [][]string
+		seen    = make(map[string]bool)
+	)
+
+	for depth := 1; ; depth++ {
+		found := false
+		for _, path := range paths {
+			if len(path.keys) <= depth {
+				continue
+			}
+
+			found = true
+			parent := path.keys[:depth]
+			if key := textArray(parent); !seen[key] {
+				seen[key] = true
+				parents = append(parents, parent)
+			}
+		}
+
+		if !found {
+			return parents
+		}
+	}
+}
+
+// textArray formats the keys as a Postgres text array literal
+func textArray(keys []string) string {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(key) + `"`
+	}
+
+	return "{" + strings.Join(quoted, ",") + "}"
+}
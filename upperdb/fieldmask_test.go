@@ -0,0 +1,389 @@
+package upperdb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+)
+
+type Settings struct {
+	Theme    string            `json:"theme"`
+	Language string            `json:"language,omitempty"`
+	Extra    map[string]string `json:"extra"`
+}
+
+type settingsResource struct {
+	Name     string    `db:"name"`
+	Quantity int       `db:"quantity"`
+	Settings *Settings `db:"settings"`
+}
+
+func TestUpdateColumnsValuesJSONB(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(settingsResource{}),
+		Include([]string{"Name", "Settings"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &settingsResource{
+		Name:     "CAN",
+		Quantity: 3,
+		Settings: &Settings{
+			Theme:    "dark",
+			Language: "en",
+			Extra:    map[string]string{"a.b": "c"},
+		},
+	}
+
+	var tests = []struct {
+		name            string
+		given           []string
+		expectedColumns []string
+		expectedRaw     string
+		expectedArgs    []interface{}
+	}{
+		{
+			name:            "Single path",
+			given:           []string{"Settings.Theme"},
+			expectedColumns: []string{"settings"},
+			expectedRaw:     `jsonb_set(CASE WHEN jsonb_typeof("settings") = 'object' THEN "settings" ELSE '{}'::jsonb END, ?::text[], ?::jsonb)`,
+			expectedArgs:    []interface{}{`{"theme"}`, `"dark"`},
+		},
+		{
+			name:            "Json names and map keys",
+			given:           []string{"Name", "Settings.language", "Settings.Extra.a"},
+			expectedColumns: []string{"name", "settings"},
+			expectedRaw: `jsonb_set(jsonb_set(jsonb_set(CASE WHEN jsonb_typeof("settings") = 'object' THEN "settings" ELSE '{}'::jsonb END, ` +
+				`?::text[], CASE WHEN jsonb_typeof("settings" #> ?::text[]) = 'object' THEN "settings" #> ?::text[] ELSE '{}'::jsonb END), ` +
+				`?::text[], ?::jsonb), ?::text[], ?::jsonb)`,
+			expectedArgs: []interface{}{`{"extra"}`, `{"extra"}`, `{"extra"}`, `{"language"}`, `"en"`, `{"extra","a"}`, `null`},
+		},
+		{
+			name:            "Whole column has preference",
+			given:           []string{"Settings", "Settings.Theme"},
+			expectedColumns: []string{"settings"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, values, err := mut.updateColumnsValues(r, tt.given, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if equal := cmp.Equal(tt.expectedColumns, columns); !equal {
+				diff := cmp.Diff(tt.expectedColumns, columns)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			raw, ok := values[len(values)-1].(db.RawValue)
+			if tt.expectedRaw == "" {
+				if ok {
+					t.Errorf("%s: expecting the whole column, got %s", tt.name, raw)
+				}
+				return
+			}
+
+			if !ok {
+				t.Fatalf("%s: expecting a raw value, got %T", tt.name, values[len(values)-1])
+			}
+
+			if raw.Raw() != tt.expectedRaw {
+				t.Errorf("%s: got %s, want %s", tt.name, raw.Raw(), tt.expectedRaw)
+			}
+
+			if equal := cmp.Equal(tt.expectedArgs, raw.Arguments()); !equal {
+				diff := cmp.Diff(tt.expectedArgs, raw.Arguments())
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestUpdateColumnsValuesJSONBMissingParents(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(settingsResource{}),
+		Include([]string{"Name", "Settings"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &settingsResource{Settings: &Settings{Theme: "dark", Extra: map[string]string{"a": "x"}}}
+	_, values, err := mut.updateColumnsValues(r, []string{"Settings.Theme", "Settings.Extra.a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := values[0].(db.RawValue)
+
+	var tests = []struct {
+		name     string
+		given    string
+		expected string
+	}{
+		{
+			name:     "Null column",
+			expected: `{"theme":"dark","extra":{"a":"x"}}`,
+		},
+		{
+			name:     "Empty object",
+			given:    `{}`,
+			expected: `{"theme":"dark","extra":{"a":"x"}}`,
+		},
+		{
+			name:     "Parent is not an object",
+			given:    `{"extra":"y"}`,
+			expected: `{"theme":"dark","extra":{"a":"x"}}`,
+		},
+		{
+			name:     "Existing keys are kept",
+			given:    `{"language":"es","extra":{"b":"y"}}`,
+			expected: `{"language":"es","theme":"dark","extra":{"a":"x","b":"y"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var column, expected interface{}
+			if tt.given != "" {
+				column = decodeJSON(t, tt.given)
+			}
+			expected = decodeJSON(t, tt.expected)
+
+			eval := &jsonbEval{t: t, expr: raw.Raw(), args: raw.Arguments(), column: column}
+			got := eval.expression()
+			if eval.expr != "" || len(eval.args) != 0 {
+				t.Fatalf("%s: unexpected expression %q with %d arguments left", tt.name, eval.expr, len(eval.args))
+			}
+
+			if equal := cmp.Equal(expected, got); !equal {
+				diff := cmp.Diff(expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+// jsonbEval evaluates the jsonb_set expressions built by jsonbColumnsValues for the settings
+// column, with the semantics of postgres: jsonb_set returns the target unchanged when the
+// parent of the key is missing, and a nil value is a NULL column
+type jsonbEval struct {
+	t      *testing.T
+	expr   string
+	args   []interface{}
+	column interface{}
+}
+
+func (e *jsonbEval) expression() interface{} {
+	switch {
+	case e.consume("jsonb_set("):
+		target := e.expression()
+		e.expect(", ?::text[]")
+		path := e.path()
+		e.expect(", ")
+		value := e.expression()
+		e.expect(")")
+
+		return jsonbSet(target, path, value)
+	case e.consume("CASE WHEN jsonb_typeof("):
+		value := e.source()
+		e.expect(") = 'object' THEN ")
+		then := e.source()
+		e.expect(" ELSE '{}'::jsonb END")
+
+		if _, ok := value.(map[string]interface{}); ok {
+			return then
+		}
+
+		return map[string]interface{}{}
+	case e.consume("?::jsonb"):
+		return decodeJSON(e.t, e.arg())
+	}
+
+	e.t.Fatalf("unexpected expression %q", e.expr)
+	return nil
+}
+
+func (e *jsonbEval) source() interface{} {
+	e.expect(`"settings"`)
+	if !e.consume(" #> ?::text[]") {
+		return e.column
+	}
+
+	value := e.column
+	for _, key := range e.path() {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		value = object[key]
+	}
+
+	return value
+}
+
+func (e *jsonbEval) path() []string {
+	var keys []string
+	arg := e.arg()
+	if err := json.Unmarshal([]byte("["+arg[1:len(arg)-1]+"]"), &keys); err != nil {
+		e.t.Fatal(err)
+	}
+
+	return keys
+}
+
+func (e *jsonbEval) arg() string {
+	if len(e.args) == 0 {
+		e.t.Fatalf("missing argument for %q", e.expr)
+	}
+
+	arg := e.args[0].(string)
+	e.args = e.args[1:]
+	return arg
+}
+
+func (e *jsonbEval) consume(prefix string) bool {
+	if !strings.HasPrefix(e.expr, prefix) {
+		return false
+	}
+
+	e.expr = e.expr[len(prefix):]
+	return true
+}
+
+func (e *jsonbEval) expect(prefix string) {
+	if !e.consume(prefix) {
+		e.t.Fatalf("expecting %q, got %q", prefix, e.expr)
+	}
+}
+
+// jsonbSet returns a copy of target with the value at the given path, target is returned
+// unchanged when a parent of the path is not an object
+func jsonbSet(target interface{}, path []string, value interface{}) interface{} {
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		return target
+	}
+
+	copied := make(map[string]interface{}, len(object))
+	for key, v := range object {
+		copied[key] = v
+	}
+
+	if len(path) == 1 {
+		copied[path[0]] = value
+		return copied
+	}
+
+	child, ok := object[path[0]]
+	if !ok {
+		return target
+	}
+
+	if _, ok := child.(map[string]interface{}); !ok {
+		return target
+	}
+
+	copied[path[0]] = jsonbSet(child, path[1:], value)
+	return copied
+}
+
+func decodeJSON(t *testing.T, data string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestUpdateColumnsValuesInvalidPath(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(settingsResource{}),
+		Exclude([]string{"Quantity"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, given := range []string{"Country", "Settings.Color", "Name.First", "Settings.Theme.Dark"} {
+		_, _, err := mut.updateColumnsValues(&settingsResource{}, []string{given}, nil)
+		if !errors.IsKind(err, errors.Invalid) {
+			t.Errorf("%s: expecting an invalid error, got %v", given, err)
+		}
+	}
+}
+
+func TestReadColumns(t *testing.T) {
+	var tests = []struct {
+		name     string
+		given    interface{}
+		readMask []string
+		expected []interface{}
+	}{
+		{
+			name:     "Fields",
+			given:    settingsResource{},
+			readMask: []string{"Quantity", "Name"},
+			expected: []interface{}{"quantity", "name"},
+		},
+		{
+			name:     "JSONB paths select the whole column",
+			given:    settingsResource{},
+			readMask: []string{"Settings.Theme", "Settings.Extra.color"},
+			expected: []interface{}{"settings"},
+		},
+		{
+			name:     "Inline struct",
+			given:    embeddedResource{},
+			readMask: []string{"Metadata", "Name"},
+			expected: []interface{}{"labels", "name"},
+		},
+		{
+			name:     "Wildcard",
+			given:    settingsResource{},
+			readMask: []string{"Name", "*"},
+		},
+	}
+
+	for _, tt := range tests {
+		mut, err := NewPartialMutation(
+			Values(tt.given),
+			Include([]string{"Name"}),
+			Table("resources"),
+			Session(&databaseMock{}),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := mut.readColumns(tt.readMask)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if equal := cmp.Equal(tt.expected, got); !equal {
+			diff := cmp.Diff(tt.expected, got)
+			t.Errorf("%s: +got, -want, %s", tt.name, diff)
+		}
+	}
+}
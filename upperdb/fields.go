@@ -0,0 +1,177 @@
+package upperdb
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mishudark/errors"
+)
+
+// structField is a field of the struct provided with Values that is mapped to a column
+type structField struct {
+	// name is the field name used by Include, Exclude and the field masks, the fields of
+	// anonymous embedded structs are promoted like in Go, the fields of named inline
+	// structs are prefixed with the struct field name, e.g. Metadata.Labels
+	name   string
+	column string
+	typ    reflect.Type
+	index  []int
+	depth  int
+	// autoCreate and autoUpdate are set with the autocreate and autoupdate tag options, the
+	// values of these fields are managed by PartialMutation
+	autoCreate bool
+	autoUpdate bool
+	// ambiguous is set when another field of the same name is found at the same depth, it is an
+	// error unless a shallower field wins
+	ambiguous bool
+}
+
+// structFields discovers the fields of the given struct type with a db tag, pointers are
+// dereferenced, anonymous embedded structs and fields tagged with db:",inline" are flattened
+func structFields(t reflect.Type) (map[string]structField, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil, errors.E(errors.Errorf("expecting a struct but got %s", t), errors.Invalid)
+	}
+
+	fields := make(map[string]structField)
+	if err := collectStructFields(t, nil, "", 0, fields); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if fields[name].ambiguous {
+			return nil, errors.E(errors.Errorf("ambiguous field %s in %s", name, t), errors.Invalid)
+		}
+	}
+
+	return fields, nil
+}
+
+func collectStructFields(t reflect.Type, index []int, prefix string, depth int, fields map[string]structField) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := field.Tag.Get("db")
+		if tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		fieldIndex := append(append([]int{}, index...), i)
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		inline := (field.Anonymous && parts[0] == "") || hasTagOption(parts[1:], "inline")
+		if inline && fieldType.Kind() == reflect.Struct {
+			fieldPrefix := prefix
+			if !field.Anonymous {
+				fieldPrefix += field.Name + "."
+			}
+
+			if err := collectStructFields(fieldType, fieldIndex, fieldPrefix, depth+1, fields); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if parts[0] == "" {
+			continue
+		}
+
+		name := prefix + field.Name
+		if existing, ok := fields[name]; ok {
+			// like in Go, the shallower field wins
+			if existing.depth < depth {
+				continue
+			}
+
+			// the ambiguity is decided once every field is collected, since a shallower field
+			// found later wins
+			if existing.depth == depth {
+				existing.ambiguous = true
+				fields[name] = existing
+				continue
+			}
+		}
+
+		fields[name] = structField{
+			name:       name,
+			column:     parts[0],
+			typ:        field.Type,
+			index:      fieldIndex,
+			depth:      depth,
+			autoCreate: hasTagOption(parts[1:], "autocreate"),
+			autoUpdate: hasTagOption(parts[1:], "autoupdate"),
+		}
+	}
+
+	return nil
+}
+
+func hasTagOption(options []string, option string) bool {
+	for _, o := range options {
+		if strings.TrimSpace(o) == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fieldValues returns the values of the mapped fields of structValue, indexed by field name,
+// the fields inside nil embedded pointers are nil
+func (p *PartialMutation) fieldValues(structValue interface{}) (map[string]interface{}, error) {
+	v := reflect.ValueOf(structValue)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	if v.Type() != p.structType {
+		return nil, errors.E(errors.Errorf("expecting a %s but got %T", p.structType, structValue), errors.Invalid)
+	}
+
+	values := make(map[string]interface{}, len(p.fields))
+	for name, field := range p.fields {
+		values[name] = fieldByIndex(v, field.index)
+	}
+
+	return values, nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but it returns nil instead of panic
+// when an embedded pointer is nil
+func fieldByIndex(v reflect.Value, index []int) interface{} {
+	for i, x := range index {
+		if i > 0 {
+			for v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return nil
+				}
+
+				v = v.Elem()
+			}
+		}
+
+		v = v.Field(x)
+	}
+
+	return v.Interface()
+}
@@ -0,0 +1,214 @@
+package upperdb
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+)
+
+type Timestamps struct {
+	CreateTime time.Time `db:"create_time"`
+	UpdateTime time.Time `db:"update_time"`
+}
+
+type Metadata struct {
+	Labels string `db:"labels"`
+}
+
+type embeddedResource struct {
+	*Timestamps
+	Name     string   `db:"name"`
+	Metadata Metadata `db:",inline"`
+	Ignored  string   `db:"-"`
+	NoTag    string
+}
+
+func TestStructFields(t *testing.T) {
+	var tests = []struct {
+		name     string
+		given    interface{}
+		expected map[string]string
+	}{
+		{
+			name:  "Flat struct",
+			given: Resource{},
+			expected: map[string]string{
+				"Name":        "name",
+				"DisplayName": "display_name",
+				"Quantity":    "quantity",
+				"CreateTime":  "create_time",
+				"UpdateTime":  "update_time",
+			},
+		},
+		{
+			name:  "Pointer",
+			given: &Resource{},
+			expected: map[string]string{
+				"Name":        "name",
+				"DisplayName": "display_name",
+				"Quantity":    "quantity",
+				"CreateTime":  "create_time",
+				"UpdateTime":  "update_time",
+			},
+		},
+		{
+			name:  "Embedded and inline structs",
+			given: embeddedResource{},
+			expected: map[string]string{
+				"CreateTime":      "create_time",
+				"UpdateTime":      "update_time",
+				"Name":            "name",
+				"Metadata.Labels": "labels",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mut, err := NewPartialMutation(
+				Values(tt.given),
+				Include([]string{"Name"}),
+				Table("resources"),
+				Session(&databaseMock{}),
+			)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if equal := cmp.Equal(tt.expected, mut.fieldsMap); !equal {
+				diff := cmp.Diff(tt.expected, mut.fieldsMap)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestStructFieldsShadowing(t *testing.T) {
+	type shallower struct {
+		Metadata
+		Labels string `db:"own_labels"`
+	}
+
+	fields, err := structFields(reflect.TypeOf(shallower{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if column := fields["Labels"].column; column != "own_labels" {
+		t.Errorf("expecting the shallower field to win, got %s", column)
+	}
+
+	type ambiguous struct {
+		Metadata
+		Metadata2 `db:",inline"`
+	}
+
+	_, err = structFields(reflect.TypeOf(ambiguous{}))
+	if !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error, got %v", err)
+	}
+
+	// the ambiguous fields are shadowed by a shallower one, declared before or after them
+	type shadowedAfter struct {
+		Metadata
+		Metadata2 `db:",inline"`
+		Labels    string `db:"own_labels"`
+	}
+
+	type shadowedBefore struct {
+		Labels string `db:"own_labels"`
+		Metadata
+		Metadata2 `db:",inline"`
+	}
+
+	for _, shadowed := range []interface{}{shadowedAfter{}, shadowedBefore{}} {
+		fields, err := structFields(reflect.TypeOf(shadowed))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if column := fields["Labels"].column; column != "own_labels" {
+			t.Errorf("%T: expecting the shallower field to win, got %s", shadowed, column)
+		}
+	}
+}
+
+type Metadata2 struct {
+	Labels string `db:"labels2"`
+}
+
+func TestColumnValuesEmbedded(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(&embeddedResource{}),
+		Exclude([]string{"UpdateTime"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name            string
+		given           *embeddedResource
+		expectedColumns []string
+		expectedValues  []interface{}
+	}{
+		{
+			name: "Embedded pointer",
+			given: &embeddedResource{
+				Timestamps: &Timestamps{CreateTime: createTime},
+				Name:       "CAN",
+				Metadata:   Metadata{Labels: "country"},
+			},
+			expectedColumns: []string{"create_time", "labels", "name"},
+			expectedValues:  []interface{}{createTime, "country", "CAN"},
+		},
+		{
+			name: "Nil embedded pointer",
+			given: &embeddedResource{
+				Name: "CAN",
+			},
+			expectedColumns: []string{"create_time", "labels", "name"},
+			expectedValues:  []interface{}{nil, "", "CAN"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, values, err := mut.getColumnsValuesExcluding(tt.given, mut.excludeFields)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]interface{})
+			for i := range columns {
+				got[columns[i]] = values[i]
+			}
+
+			sort.Strings(columns)
+			sortedValues := make([]interface{}, len(columns))
+			for i, column := range columns {
+				sortedValues[i] = got[column]
+			}
+
+			if equal := cmp.Equal(tt.expectedColumns, columns); !equal {
+				diff := cmp.Diff(tt.expectedColumns, columns)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			if equal := cmp.Equal(tt.expectedValues, sortedValues); !equal {
+				diff := cmp.Diff(tt.expectedValues, sortedValues)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,494 @@
+package upperdb
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+)
+
+// The filter language is a subset of https://google.aip.dev/160, e.g.
+//
+//	quantity > 3 AND display_name:"Can*" OR NOT archived
+//
+// Like in AIP-160, OR has higher precedence than AND, so the example above is
+// read as quantity > 3 AND (display_name:"Can*" OR NOT archived)
+
+// filterNode is a node of a parsed filter expression
+type filterNode interface{}
+
+type filterAnd struct {
+	nodes []filterNode
+}
+
+type filterOr struct {
+	nodes []filterNode
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+// filterComparison compares a field with a value, a comparison without operator
+// is a bare field, which is only valid for bool fields
+type filterComparison struct {
+	field    string
+	operator string
+	value    filterValue
+}
+
+type filterValue struct {
+	text   string
+	quoted bool
+}
+
+type filterTokenKind int
+
+const (
+	filterEOF filterTokenKind = iota
+	filterWord
+	filterString
+	filterOperator
+	filterLParen
+	filterRParen
+	filterMinus
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+func invalidFilter(format string, args ...interface{}) error {
+	return errors.E(errors.Errorf("invalid filter, "+format, args...), errors.Invalid)
+}
+
+// lexFilter splits a filter expression in tokens
+func lexFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{kind: filterLParen, text: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{kind: filterRParen, text: ")", pos: i})
+			i++
+		case r == '-' && (i+1 >= len(runes) || !unicode.IsDigit(runes[i+1])):
+			tokens = append(tokens, filterToken{kind: filterMinus, text: "-", pos: i})
+			i++
+		case r == '=' || r == ':':
+			tokens = append(tokens, filterToken{kind: filterOperator, text: string(r), pos: i})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+
+			if op == "!" {
+				return nil, invalidFilter("unexpected %q at %d", op, i)
+			}
+
+			tokens = append(tokens, filterToken{kind: filterOperator, text: op, pos: i})
+			i += len(op)
+		case r == '"' || r == '\'':
+			start := i
+			var text []rune
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text = append(text, runes[i])
+			}
+
+			if i >= len(runes) {
+				return nil, invalidFilter("unterminated string at %d", start)
+			}
+
+			tokens = append(tokens, filterToken{kind: filterString, text: string(text), pos: start})
+			i++
+		case isFilterWordRune(r):
+			start := i
+			for i < len(runes) && isFilterWordRune(runes[i]) {
+				i++
+			}
+
+			tokens = append(tokens, filterToken{kind: filterWord, text: string(runes[start:i]), pos: start})
+		default:
+			return nil, invalidFilter("unexpected %q at %d", string(r), i)
+		}
+	}
+
+	return append(tokens, filterToken{kind: filterEOF, pos: len(runes)}), nil
+}
+
+func isFilterWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.*+-", r)
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseFilter parses a filter expression, an empty filter returns a nil node
+func parseFilter(filter string) (filterNode, error) {
+	tokens, err := lexFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+	if parser.peek().kind == filterEOF {
+		return nil, nil
+	}
+
+	node, err := parser.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := parser.peek(); tok.kind != filterEOF {
+		return nil, invalidFilter("unexpected %q at %d", tok.text, tok.pos)
+	}
+
+	return node, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != filterEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+func (p *filterParser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == filterWord && tok.text == keyword
+}
+
+// expression: sequence { "AND" sequence }
+func (p *filterParser) expression() (filterNode, error) {
+	return p.list("AND", p.sequence, func(nodes []filterNode) filterNode { return filterAnd{nodes: nodes} })
+}
+
+// sequence: factor { factor }, the factors are implicitly joined with AND
+func (p *filterParser) sequence() (filterNode, error) {
+	node, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []filterNode{node}
+	for p.startsTerm() {
+		node, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+
+	return filterAnd{nodes: nodes}, nil
+}
+
+// factor: term { "OR" term }
+func (p *filterParser) factor() (filterNode, error) {
+	return p.list("OR", p.term, func(nodes []filterNode) filterNode { return filterOr{nodes: nodes} })
+}
+
+func (p *filterParser) list(keyword string, parse func() (filterNode, error), join func([]filterNode) filterNode) (filterNode, error) {
+	node, err := parse()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []filterNode{node}
+	for p.isKeyword(keyword) {
+		p.next()
+
+		node, err := parse()
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+
+	return join(nodes), nil
+}
+
+func (p *filterParser) startsTerm() bool {
+	tok := p.peek()
+	switch tok.kind {
+	case filterLParen, filterMinus:
+		return true
+	case filterWord:
+		return tok.text != "AND" && tok.text != "OR"
+	}
+
+	return false
+}
+
+// term: [ "NOT" | "-" ] simple
+func (p *filterParser) term() (filterNode, error) {
+	if p.isKeyword("NOT") || p.peek().kind == filterMinus {
+		p.next()
+
+		node, err := p.simple()
+		if err != nil {
+			return nil, err
+		}
+
+		return filterNot{node: node}, nil
+	}
+
+	return p.simple()
+}
+
+// simple: "(" expression ")" | field [ operator value ]
+func (p *filterParser) simple() (filterNode, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case filterLParen:
+		node, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		if closing := p.next(); closing.kind != filterRParen {
+			return nil, invalidFilter("expecting \")\" at %d", closing.pos)
+		}
+
+		return node, nil
+	case filterWord:
+		if tok.text == "AND" || tok.text == "OR" || tok.text == "NOT" {
+			return nil, invalidFilter("unexpected %q at %d", tok.text, tok.pos)
+		}
+	default:
+		return nil, invalidFilter("expecting a field at %d", tok.pos)
+	}
+
+	comparison := filterComparison{field: tok.text}
+	if p.peek().kind != filterOperator {
+		return comparison, nil
+	}
+
+	comparison.operator = p.next().text
+
+	value := p.next()
+	if value.kind != filterWord && value.kind != filterString {
+		return nil, invalidFilter("expecting a value at %d", value.pos)
+	}
+
+	comparison.value = filterValue{text: value.text, quoted: value.kind == filterString}
+	return comparison, nil
+}
+
+// ParseFilter validates a filter expression against the fields of the struct provided
+// with Values, and returns the equivalent condition, fields can be referenced by its
+// db column or by its struct field name
+// Unknown fields, type mismatches and syntax errors are returned as errors.Invalid
+func (p *PartialMutation) ParseFilter(filter string) (db.Compound, error) {
+	node, err := parseFilter(filter)
+	if err != nil || node == nil {
+		return nil, err
+	}
+
+	return p.compileFilter(node, false)
+}
+
+// compileFilter converts a parsed filter to a condition, negations are pushed down to
+// the comparisons, which is equivalent in SQL three-valued logic
+func (p *PartialMutation) compileFilter(node filterNode, negate bool) (db.Compound, error) {
+	switch n := node.(type) {
+	case filterAnd:
+		conds, err := p.compileFilters(n.nodes, negate)
+		if err != nil {
+			return nil, err
+		}
+
+		if negate {
+			return db.Or(conds...), nil
+		}
+
+		return db.And(conds...), nil
+	case filterOr:
+		conds, err := p.compileFilters(n.nodes, negate)
+		if err != nil {
+			return nil, err
+		}
+
+		if negate {
+			return db.And(conds...), nil
+		}
+
+		return db.Or(conds...), nil
+	case filterNot:
+		return p.compileFilter(n.node, !negate)
+	case filterComparison:
+		return p.compileComparison(n, negate)
+	}
+
+	return nil, errors.E(errors.Errorf("compileFilter operation, unexpected node %T", node), errors.Internal)
+}
+
+func (p *PartialMutation) compileFilters(nodes []filterNode, negate bool) ([]db.Compound, error) {
+	conds := make([]db.Compound, len(nodes))
+	for i, node := range nodes {
+		cond, err := p.compileFilter(node, negate)
+		if err != nil {
+			return nil, err
+		}
+
+		conds[i] = cond
+	}
+
+	return conds, nil
+}
+
+// negatedFilterOperators maps each operator to its negation
+var negatedFilterOperators = map[string]string{
+	"=":  "!=",
+	"!=": "=",
+	"<":  ">=",
+	">=": "<",
+	">":  "<=",
+	"<=": ">",
+}
+
+func (p *PartialMutation) compileComparison(c filterComparison, negate bool) (db.Compound, error) {
+	column, fieldType, ok := p.resolveField(c.field)
+	if !ok {
+		return nil, invalidFilter("unknown field %s", c.field)
+	}
+
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+
+	operator := c.operator
+	if operator == ":" {
+		operator = "="
+	}
+
+	// a bare field is a shortcut for field = true
+	if operator == "" {
+		if fieldType.Kind() != reflect.Bool {
+			return nil, invalidFilter("field %s is not a bool, a comparison is required", c.field)
+		}
+
+		operator, c.value = "=", filterValue{text: "true"}
+	}
+
+	if negate {
+		operator = negatedFilterOperators[operator]
+	}
+
+	if !c.value.quoted && c.value.text == "null" {
+		switch operator {
+		case "=":
+			return db.Cond{column: db.IsNull()}, nil
+		case "!=":
+			return db.Cond{column: db.IsNotNull()}, nil
+		}
+
+		return nil, invalidFilter("null can only be compared with = or !=, field %s", c.field)
+	}
+
+	if fieldType.Kind() == reflect.String && strings.Contains(c.value.text, "*") {
+		pattern := likePattern(c.value.text)
+		switch operator {
+		case "=":
+			return db.Cond{column: db.Like(pattern)}, nil
+		case "!=":
+			return db.Cond{column: db.NotLike(pattern)}, nil
+		}
+
+		return nil, invalidFilter("wildcards can only be used with =, != or :, field %s", c.field)
+	}
+
+	value, err := filterFieldValue(fieldType, c.value.text)
+	if err != nil {
+		return nil, invalidFilter("field %s expects a %s value, got %q", c.field, fieldType, c.value.text)
+	}
+
+	if fieldType.Kind() == reflect.Bool && operator != "=" && operator != "!=" {
+		return nil, invalidFilter("bool field %s can only be compared with = or !=", c.field)
+	}
+
+	switch operator {
+	case "=":
+		return db.Cond{column: db.Eq(value)}, nil
+	case "!=":
+		return db.Cond{column: db.NotEq(value)}, nil
+	case "<":
+		return db.Cond{column: db.Lt(value)}, nil
+	case "<=":
+		return db.Cond{column: db.Lte(value)}, nil
+	case ">":
+		return db.Cond{column: db.Gt(value)}, nil
+	case ">=":
+		return db.Cond{column: db.Gte(value)}, nil
+	}
+
+	return nil, invalidFilter("unknown operator %s", c.operator)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// filterFieldValue converts the text of a value to the type of the field
+func filterFieldValue(fieldType reflect.Type, text string) (interface{}, error) {
+	if fieldType == timeType {
+		return time.Parse(time.RFC3339Nano, text)
+	}
+
+	switch fieldType.Kind() {
+	case reflect.String:
+		return text, nil
+	case reflect.Bool:
+		return strconv.ParseBool(text)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(text, 10, fieldType.Bits())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(text, 10, fieldType.Bits())
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(text, fieldType.Bits())
+	}
+
+	return nil, errors.Errorf("unsupported type %s", fieldType)
+}
+
+// likePattern converts a value with * wildcards to a LIKE pattern, escaping the LIKE
+// special characters
+func likePattern(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `%`)
+	return replacer.Replace(text)
+}
@@ -0,0 +1,166 @@
+package upperdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+)
+
+type filterResource struct {
+	Name        string `db:"name"`
+	DisplayName string `db:"display_name"`
+	Quantity    int    `db:"quantity"`
+	Archived    bool   `db:"archived"`
+	Tags        []string
+}
+
+var comparisonOperators = map[db.ComparisonOperator]string{
+	db.ComparisonOperatorEqual:                "=",
+	db.ComparisonOperatorNotEqual:             "!=",
+	db.ComparisonOperatorLessThan:             "<",
+	db.ComparisonOperatorGreaterThan:          ">",
+	db.ComparisonOperatorLessThanOrEqualTo:    "<=",
+	db.ComparisonOperatorGreaterThanOrEqualTo: ">=",
+	db.ComparisonOperatorIs:                   "IS",
+	db.ComparisonOperatorIsNot:                "IS NOT",
+	db.ComparisonOperatorLike:                 "LIKE",
+	db.ComparisonOperatorNotLike:              "NOT LIKE",
+}
+
+// renderCondition writes a condition in a readable form to compare it in tests
+func renderCondition(cond db.Compound) string {
+	switch c := cond.(type) {
+	case db.Cond:
+		for k, v := range c {
+			comparison := v.(db.Comparison)
+			return fmt.Sprintf("%v %s %v", k, comparisonOperators[comparison.Operator()], comparison.Value())
+		}
+	case *db.Intersection, *db.Union:
+		var parts []string
+		for _, s := range c.Sentences() {
+			parts = append(parts, renderCondition(s))
+		}
+
+		sep := " AND "
+		if c.Operator() == db.OperatorOr {
+			sep = " OR "
+		}
+
+		return "(" + strings.Join(parts, sep) + ")"
+	}
+
+	return fmt.Sprintf("%T", cond)
+}
+
+func TestParseFilter(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(filterResource{}),
+		Include([]string{"Name"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		given    string
+		expected string
+	}{
+		{
+			name:     "Comparison",
+			given:    "quantity > 3",
+			expected: "quantity > 3",
+		},
+		{
+			name:     "Struct field name",
+			given:    `DisplayName = "Canada"`,
+			expected: "display_name = Canada",
+		},
+		{
+			name:     "OR has precedence over AND",
+			given:    `quantity > 3 AND display_name:"Can*" OR NOT archived`,
+			expected: "(quantity > 3 AND (display_name LIKE Can% OR archived != true))",
+		},
+		{
+			name:     "Implicit AND",
+			given:    "name = CAN quantity <= 10",
+			expected: "(name = CAN AND quantity <= 10)",
+		},
+		{
+			name:     "Negated group",
+			given:    "-(quantity >= 3 AND name != CAN)",
+			expected: "(quantity < 3 OR name = CAN)",
+		},
+		{
+			name:     "Null",
+			given:    "NOT display_name = null",
+			expected: "display_name IS NOT <nil>",
+		},
+		{
+			name:     "Escaped wildcard",
+			given:    `name = "100%_*"`,
+			expected: `name LIKE 100\%\_%`,
+		},
+		{
+			name:     "Negative number",
+			given:    "quantity = -1",
+			expected: "quantity = -1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond, err := mut.ParseFilter(tt.given)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := renderCondition(cond); got != tt.expected {
+				t.Errorf("%s: got %s, want %s", tt.name, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseFilterInvalid(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(filterResource{}),
+		Include([]string{"Name"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name  string
+		given string
+	}{
+		{name: "Unknown field", given: "country = CAN"},
+		{name: "Field without db tag", given: "Tags = a"},
+		{name: "Type mismatch", given: "quantity > many"},
+		{name: "Bare field is not a bool", given: "NOT quantity"},
+		{name: "Bool with order operator", given: "archived > false"},
+		{name: "Missing value", given: "quantity >"},
+		{name: "Unbalanced parenthesis", given: "(quantity > 3"},
+		{name: "Unterminated string", given: `name = "CAN`},
+		{name: "Dangling operator", given: "quantity > 3 AND"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mut.ParseFilter(tt.given)
+			if !errors.IsKind(err, errors.Invalid) {
+				t.Errorf("%s: expecting an invalid error, got %v", tt.name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package upperdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// instrument starts a trace span of a database operation, as a child of the span of ctx, the
+// returned function records the latency and the error of the operation, and ends the span
+func instrument(ctx context.Context, table, operation string) (context.Context, func(err *error)) {
+	ctx, span := trace.StartSpan(ctx, "upperdb."+operation)
+	span.AddAttributes(trace.StringAttribute("db.table", table))
+
+	tagCtx, tagErr := tag.New(ctx, tag.Upsert(metrics.KeyTable, table), tag.Upsert(metrics.KeyOperation, operation))
+	start := time.Now()
+
+	return ctx, func(err *error) {
+		defer span.End()
+
+		if err != nil && *err != nil {
+			span.SetStatus(trace.Status{Code: traceCode(*err), Message: (*err).Error()})
+		}
+
+		if tagErr != nil {
+			return
+		}
+
+		ms := float64(time.Since(start).Nanoseconds()) / 1e6
+		stats.Record(tagCtx, metrics.DBLatencyMs.M(ms))
+
+		if err != nil && *err != nil {
+			stats.Record(tagCtx, metrics.DBErrors.M(1))
+		}
+	}
+}
+
+// recordCache records a hit or a miss of the collection cache
+func recordCache(table string, hit bool) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(metrics.KeyTable, table))
+	if err != nil {
+		return
+	}
+
+	if hit {
+		stats.Record(ctx, metrics.CollectionCacheHits.M(1))
+		return
+	}
+
+	stats.Record(ctx, metrics.CollectionCacheMisses.M(1))
+}
+
+// traceCode maps the kind of an error to a trace status code, they are the gRPC codes
+func traceCode(err error) int32 {
+	switch {
+	case errors.IsKind(err, errors.Invalid):
+		return trace.StatusCodeInvalidArgument
+	case errors.IsKind(err, errors.NotExist):
+		return trace.StatusCodeNotFound
+	case errors.IsKind(err, errors.Duplicated):
+		return trace.StatusCodeAlreadyExists
+	case errors.IsKind(err, errors.Permission):
+		return trace.StatusCodePermissionDenied
+	case errors.IsKind(err, errors.Transient):
+		return trace.StatusCodeUnavailable
+	case errors.IsKind(err, errors.Internal):
+		return trace.StatusCodeInternal
+	}
+
+	return trace.StatusCodeUnknown
+}
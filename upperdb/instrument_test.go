@@ -0,0 +1,79 @@
+package upperdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/metrics"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = append(r.spans, s)
+}
+
+func TestInstrument(t *testing.T) {
+	if err := view.Register(metrics.DBLatencyView, metrics.DBErrorCountView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.DBLatencyView, metrics.DBErrorCountView)
+
+	recorder := &spanRecorder{}
+	trace.RegisterExporter(recorder)
+	defer trace.UnregisterExporter(recorder)
+
+	ctx, parent := trace.StartSpan(context.Background(), "request", trace.WithSampler(trace.AlwaysSample()))
+
+	_, end := instrument(ctx, "resources", "update")
+	err := errors.E(errors.New("not found"), errors.NotExist)
+	end(&err)
+	parent.End()
+
+	rows, retrieveErr := view.RetrieveData(metrics.DBErrorCountView.Name)
+	if retrieveErr != nil {
+		t.Fatal(retrieveErr)
+	}
+
+	expectedTags := map[tag.Key]string{metrics.KeyTable: "resources", metrics.KeyOperation: "update"}
+	if len(rows) != 1 || len(rows[0].Tags) != len(expectedTags) {
+		t.Fatalf("expecting a row with the table and operation tags, got %v", rows)
+	}
+
+	for _, tg := range rows[0].Tags {
+		if expectedTags[tg.Key] != tg.Value {
+			t.Errorf("unexpected tag %s=%s", tg.Key.Name(), tg.Value)
+		}
+	}
+
+	if rows[0].Data.(*view.CountData).Value != 1 {
+		t.Errorf("expecting an error, got %v", rows[0].Data)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if len(recorder.spans) != 2 {
+		t.Fatalf("expecting 2 spans, got %d", len(recorder.spans))
+	}
+
+	span := recorder.spans[0]
+	if span.Name != "upperdb.update" || span.ParentSpanID != parent.SpanContext().SpanID {
+		t.Errorf("expecting an upperdb.update child span, got %s", span.Name)
+	}
+
+	if span.Status.Code != trace.StatusCodeNotFound {
+		t.Errorf("expecting a not found status, got %d", span.Status.Code)
+	}
+}
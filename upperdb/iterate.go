@@ -0,0 +1,64 @@
+package upperdb
+
+import (
+	"context"
+	"reflect"
+
+	db "upper.io/db.v3"
+)
+
+// Iterate calls fn with each row that matches the filter expression (see ParseFilter), ordered
+// by the given order_by string like List, without pages. The rows are streamed from the
+// database one by one, and each row is decoded into a new pointer to the struct provided with
+// Values. The iteration stops at the first error returned by fn, and it is returned as is
+// If soft delete is enabled, the deleted rows are skipped
+// If read replicas are enabled, the rows are read from a healthy replica, see ReadFromPrimary
+func (p *PartialMutation) Iterate(ctx context.Context, filter, orderBy string, fn func(item interface{}) error) (err error) {
+	ctx, end := instrument(ctx, p.table, "iterate")
+	defer end(&err)
+
+	columns, err := p.sortColumns(orderBy)
+	if err != nil {
+		return err
+	}
+
+	cond, err := p.ParseFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	tenant, err := p.tenantCond(ctx, "iterate")
+	if err != nil {
+		return err
+	}
+
+	sess, _ := p.readSession(ctx)
+	query := sess.SelectFrom(p.table).Where(tenant)
+	if cond != nil {
+		query = query.And(cond)
+	}
+
+	if p.softDeleteColumn != "" {
+		query = query.And(db.Cond{p.softDeleteColumn: db.IsNull()})
+	}
+
+	iter := query.OrderBy(orderByColumns(columns)...).IteratorContext(ctx)
+	defer iter.Close() // nolint: errcheck
+
+	for {
+		item := reflect.New(p.structType).Interface()
+		if !iter.Next(item) {
+			break
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	if err := iter.Err(); err != nil && err != db.ErrNoMoreRows {
+		return translateError(err, "iterate", p.table)
+	}
+
+	return nil
+}
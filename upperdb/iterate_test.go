@@ -0,0 +1,63 @@
+package upperdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/upperdb/upperdbtest"
+)
+
+func TestIterate(t *testing.T) {
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"CAN", "MEX", "USA", "ARG"} {
+		if err := mut.Insert(sess, &storedResource{Name: name, Quantity: i}, "name", name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	err = mut.Iterate(context.Background(), "quantity > 0", "name", func(item interface{}) error {
+		got = append(got, item.(*storedResource).Name)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ARG", "MEX", "USA"}
+	if equal := cmp.Equal(expected, got); !equal {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = mut.Iterate(context.Background(), "", "", func(item interface{}) error {
+		calls++
+		return stop
+	})
+
+	if err != stop || calls != 1 {
+		t.Errorf("expecting the iteration to stop at the first error, got %v after %d calls", err, calls)
+	}
+
+	if err := mut.Iterate(context.Background(), "color = 1", "", func(item interface{}) error { return nil }); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid filter error, got %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+package upperdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mishudark/errors"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// Migration is a versioned schema change, it is read from the files <version>_<name>.up.sql and
+// <version>_<name>.down.sql, e.g. 0001_create_resources.up.sql, the down file is optional
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and whether it is applied
+type MigrationStatus struct {
+	Migration
+	Applied     bool
+	AppliedTime time.Time
+}
+
+// migrationRow is an applied migration as it is stored in the migrations table
+type migrationRow struct {
+	Version     int64     `db:"version"`
+	Name        string    `db:"name"`
+	AppliedTime time.Time `db:"applied_time"`
+}
+
+// migrationStep applies or reverts a migration
+type migrationStep struct {
+	migration Migration
+	up        bool
+}
+
+var (
+	migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+	// errDryRun rolls back the transaction of a dry run
+	errDryRun = errors.New("dry run")
+)
+
+// Migrator applies and reverts the migrations of a directory, every migration runs in its own
+// transaction, which holds an advisory lock, so concurrent migrators wait for each other instead
+// of applying the same migration twice. Statements that can not run inside a transaction, like
+// CREATE INDEX CONCURRENTLY, are not supported
+type Migrator struct {
+	sess       sqlbuilder.Database
+	migrations []Migration
+	table      string
+	lockID     int64
+	dryRun     io.Writer
+}
+
+// MigratorOption defines an option that changes the values of Migrator struct
+type MigratorOption func(m *Migrator)
+
+// MigrationsTable set the table that records the applied migrations, by default it is
+// schema_migrations
+func MigrationsTable(table string) MigratorOption {
+	return func(m *Migrator) {
+		m.table = table
+	}
+}
+
+// MigrationsLock set the key of the advisory lock held while migrating, by default it is derived
+// from the migrations table name
+func MigrationsLock(id int64) MigratorOption {
+	return func(m *Migrator) {
+		m.lockID = id
+	}
+}
+
+// DryRun writes the statements that would be run into w, instead of running them
+func DryRun(w io.Writer) MigratorOption {
+	return func(m *Migrator) {
+		m.dryRun = w
+	}
+}
+
+// NewMigrator returns a Migrator of the migration files in the root of fsys
+func NewMigrator(sess sqlbuilder.Database, fsys fs.FS, opts ...MigratorOption) (*Migrator, error) {
+	m := &Migrator{
+		sess:  sess,
+		table: "schema_migrations",
+	}
+
+	for _, o := range opts {
+		o(m)
+	}
+
+	if m.sess == nil || m.table == "" {
+		return nil, errors.E(errors.New("Migrator, session and migrations table are required"), errors.Invalid)
+	}
+
+	if m.lockID == 0 {
+		h := fnv.New64a()
+		h.Write([]byte("upperdb migrations " + m.table)) // nolint: errcheck
+		m.lockID = int64(h.Sum64())
+	}
+
+	migrations, err := readMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	m.migrations = migrations
+	return m, nil
+}
+
+// NewDirMigrator returns a Migrator of the migration files in the given directory
+func NewDirMigrator(sess sqlbuilder.Database, dir string, opts ...MigratorOption) (*Migrator, error) {
+	return NewMigrator(sess, os.DirFS(dir), opts...)
+}
+
+// readMigrations reads the migration files sorted by version, other files are ignored
+func readMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, errors.E(err, "readMigrations", errors.IO)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, errors.E(errors.Errorf("invalid migration version in %s", entry.Name()), errors.Invalid)
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, errors.E(err, "readMigrations", errors.IO)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != match[2] {
+			return nil, errors.E(errors.Errorf("duplicated migration version %d, %s and %s", version, migration.Name, match[2]), errors.Invalid)
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, errors.E(errors.Errorf("migration %d_%s has no up file", migration.Version, migration.Name), errors.Invalid)
+		}
+
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Status returns the migrations and whether they are applied, it is a plain read, so it does not
+// wait for a running migration, and no migration is applied when the migrations table does not
+// exist
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	row, err := m.sess.QueryRowContext(ctx, "SELECT to_regclass(?) IS NOT NULL", quoteTable(m.table))
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := row.Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]migrationRow)
+	if exists {
+		if applied, err = m.applied(ctx, m.sess); err != nil {
+			return nil, err
+		}
+	}
+
+	status := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		row, ok := applied[migration.Version]
+		status[i] = MigrationStatus{Migration: migration, Applied: ok, AppliedTime: row.AppliedTime}
+	}
+
+	return status, nil
+}
+
+// Migrate applies the pending migrations
+func (m *Migrator) Migrate(ctx context.Context) error {
+	if len(m.migrations) == 0 {
+		return nil
+	}
+
+	return m.MigrateTo(ctx, m.migrations[len(m.migrations)-1].Version)
+}
+
+// MigrateTo applies the pending migrations up to the given version, and reverts the applied
+// migrations after it, zero reverts every migration
+func (m *Migrator) MigrateTo(ctx context.Context, version int64) error {
+	for {
+		var done bool
+
+		err := RunInTx(ctx, m.sess, nil, func(tx sqlbuilder.Tx) error {
+			applied, err := m.lock(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			steps, err := m.plan(applied, version)
+			if err != nil {
+				return err
+			}
+
+			if m.dryRun != nil {
+				done = true
+				for _, step := range steps {
+					fmt.Fprintf(m.dryRun, "-- %s\n%s\n", step, step.sql()) // nolint: errcheck
+				}
+
+				return errDryRun
+			}
+
+			if len(steps) == 0 {
+				done = true
+				return nil
+			}
+
+			// the state is read again before the next step, since other migrators can run
+			// between the transactions
+			return m.apply(ctx, tx, steps[0])
+		})
+
+		if err == errDryRun {
+			return nil
+		}
+
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// lock takes the advisory lock of the migrations, creates the migrations table if it does not
+// exist, and returns the applied migrations
+func (m *Migrator) lock(ctx context.Context, tx sqlbuilder.Tx) (map[int64]migrationRow, error) {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(?)", m.lockID); err != nil {
+		return nil, err
+	}
+
+	createTable := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	version      BIGINT PRIMARY KEY,
+	name         TEXT NOT NULL,
+	applied_time TIMESTAMPTZ NOT NULL DEFAULT now()
+)`, quoteTable(m.table))
+
+	if _, err := tx.ExecContext(ctx, createTable); err != nil {
+		return nil, err
+	}
+
+	return m.applied(ctx, tx)
+}
+
+// applied returns the applied migrations by version
+func (m *Migrator) applied(ctx context.Context, sess sqlbuilder.SQLBuilder) (map[int64]migrationRow, error) {
+	var rows []migrationRow
+	if err := sess.SelectFrom(m.table).IteratorContext(ctx).All(&rows); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]migrationRow, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// plan returns the steps to migrate to the given version, the migrations after it are reverted
+// from the newest, and then the pending migrations up to it are applied from the oldest
+func (m *Migrator) plan(applied map[int64]migrationRow, version int64) ([]migrationStep, error) {
+	known := make(map[int64]bool, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+	}
+
+	if version != 0 && !known[version] {
+		return nil, errors.E(errors.Errorf("unknown migration version %d", version), errors.Invalid)
+	}
+
+	for v := range applied {
+		if !known[v] && v > version {
+			return nil, errors.E(errors.Errorf("applied migration %d has no file, it can not be reverted", v), errors.Invalid)
+		}
+	}
+
+	var steps []migrationStep
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= version {
+			continue
+		}
+
+		if migration.Down == "" {
+			return nil, errors.E(errors.Errorf("migration %d_%s has no down file", migration.Version, migration.Name), errors.Invalid)
+		}
+
+		steps = append(steps, migrationStep{migration: migration})
+	}
+
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+
+		steps = append(steps, migrationStep{migration: migration, up: true})
+	}
+
+	return steps, nil
+}
+
+// apply runs a step and records it in the migrations table
+func (m *Migrator) apply(ctx context.Context, tx sqlbuilder.Tx, step migrationStep) error {
+	// the migration runs on the underlying transaction, so its placeholders are not rewritten
+	var err error
+	if sqlTx, ok := tx.Driver().(*sql.Tx); ok {
+		_, err = sqlTx.ExecContext(ctx, step.sql())
+	} else {
+		_, err = tx.ExecContext(ctx, step.sql())
+	}
+
+	if err != nil {
+		return errors.E(err, fmt.Sprintf("migration %s failed", step), errors.Internal)
+	}
+
+	if step.up {
+		_, err = tx.InsertInto(m.table).
+			Columns("version", "name").
+			Values(step.migration.Version, step.migration.Name).
+			ExecContext(ctx)
+	} else {
+		_, err = tx.DeleteFrom(m.table).Where("version", step.migration.Version).ExecContext(ctx)
+	}
+
+	return err
+}
+
+func (s migrationStep) sql() string {
+	if s.up {
+		return s.migration.Up
+	}
+
+	return s.migration.Down
+}
+
+func (s migrationStep) String() string {
+	direction := "down"
+	if s.up {
+		direction = "up"
+	}
+
+	return fmt.Sprintf("%d_%s.%s", s.migration.Version, s.migration.Name, direction)
+}
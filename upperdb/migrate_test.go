@@ -0,0 +1,373 @@
+package upperdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+)
+
+func TestReadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_quantity.up.sql":         {Data: []byte("ALTER TABLE resources ADD quantity INT;")},
+		"0001_create_resources.up.sql":     {Data: []byte("CREATE TABLE resources (id BIGSERIAL);")},
+		"0001_create_resources.down.sql":   {Data: []byte("DROP TABLE resources;")},
+		"README.md":                        {Data: []byte("migrations")},
+		"seeds/0003_seed_resources.up.sql": {Data: []byte("INSERT INTO resources DEFAULT VALUES;")},
+	}
+
+	got, err := readMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Migration{
+		{Version: 1, Name: "create_resources", Up: "CREATE TABLE resources (id BIGSERIAL);", Down: "DROP TABLE resources;"},
+		{Version: 2, Name: "add_quantity", Up: "ALTER TABLE resources ADD quantity INT;"},
+	}
+
+	if equal := cmp.Equal(expected, got); !equal {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+}
+
+func TestReadMigrationsInvalid(t *testing.T) {
+	var tests = []struct {
+		name  string
+		given fstest.MapFS
+	}{
+		{
+			name: "Duplicated version",
+			given: fstest.MapFS{
+				"0001_create_resources.up.sql": {Data: []byte("CREATE TABLE resources ();")},
+				"0001_create_parents.up.sql":   {Data: []byte("CREATE TABLE parents ();")},
+			},
+		},
+		{
+			name: "Missing up file",
+			given: fstest.MapFS{
+				"0001_create_resources.down.sql": {Data: []byte("DROP TABLE resources;")},
+			},
+		},
+		{
+			name: "Zero version",
+			given: fstest.MapFS{
+				"0000_create_resources.up.sql": {Data: []byte("CREATE TABLE resources ();")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readMigrations(tt.given); !errors.IsKind(err, errors.Invalid) {
+				t.Errorf("%s: expecting an invalid error, got %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestMigrationPlan(t *testing.T) {
+	m := &Migrator{
+		migrations: []Migration{
+			{Version: 1, Name: "one", Up: "1 up", Down: "1 down"},
+			{Version: 2, Name: "two", Up: "2 up"},
+			{Version: 3, Name: "three", Up: "3 up", Down: "3 down"},
+		},
+	}
+
+	var tests = []struct {
+		name     string
+		applied  []int64
+		version  int64
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "Migrate from scratch",
+			version:  3,
+			expected: []string{"1_one.up", "2_two.up", "3_three.up"},
+		},
+		{
+			name:     "Pending migration before the applied ones",
+			applied:  []int64{1, 3},
+			version:  3,
+			expected: []string{"2_two.up"},
+		},
+		{
+			name:     "Revert",
+			applied:  []int64{1, 2, 3},
+			version:  2,
+			expected: []string{"3_three.down"},
+		},
+		{
+			name:    "Revert without down file",
+			applied: []int64{1, 2, 3},
+			version: 1,
+			err:     true,
+		},
+		{
+			name:    "Unknown version",
+			version: 4,
+			err:     true,
+		},
+		{
+			name:    "Applied migration without file",
+			applied: []int64{1, 4},
+			version: 3,
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied := make(map[int64]migrationRow)
+			for _, v := range tt.applied {
+				applied[v] = migrationRow{Version: v}
+			}
+
+			steps, err := m.plan(applied, tt.version)
+			if tt.err {
+				if !errors.IsKind(err, errors.Invalid) {
+					t.Errorf("%s: expecting an invalid error, got %v", tt.name, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, step := range steps {
+				got = append(got, step.String())
+			}
+
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+// migrationsTable is the CREATE TABLE statement of the migrations table, as recorded
+const migrationsTable = `CREATE TABLE IF NOT EXISTS "app"."schema_migrations" ( version BIGINT PRIMARY KEY, ` +
+	`name TEXT NOT NULL, applied_time TIMESTAMPTZ NOT NULL DEFAULT now() )`
+
+var (
+	migrationColumns = []string{"version", "name", "applied_time"}
+	migrationFiles   = fstest.MapFS{
+		"0001_one.up.sql":   {Data: []byte("CREATE TABLE one (name TEXT DEFAULT '?');")},
+		"0001_one.down.sql": {Data: []byte("DROP TABLE one;")},
+		"0002_two.up.sql":   {Data: []byte("CREATE TABLE two ();")},
+	}
+)
+
+// recordedTx returns the statements of the recorder sent in transactions, the queries run by
+// upper when the session is opened are skipped
+func recordedTx(rec *recorder) []string {
+	statements := rec.matching("")
+	for i, statement := range statements {
+		if statement == "BEGIN" {
+			return statements[i:]
+		}
+	}
+
+	return nil
+}
+
+func TestMigrateTo(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		applied  [][][]driver.Value
+		version  int64
+		expected []string
+	}{
+		{
+			name:    "Apply",
+			applied: [][][]driver.Value{nil, {{int64(1), "one", now}}, {{int64(1), "one", now}, {int64(2), "two", now}}},
+			version: 2,
+			expected: []string{
+				"BEGIN",
+				"SELECT pg_advisory_xact_lock($1)",
+				migrationsTable,
+				`SELECT * FROM "app"."schema_migrations"`,
+				"CREATE TABLE one (name TEXT DEFAULT '?');",
+				`INSERT INTO "app"."schema_migrations" ("version", "name") VALUES ($1, $2)`,
+				"COMMIT",
+				"BEGIN",
+				"SELECT pg_advisory_xact_lock($1)",
+				migrationsTable,
+				`SELECT * FROM "app"."schema_migrations"`,
+				"CREATE TABLE two ();",
+				`INSERT INTO "app"."schema_migrations" ("version", "name") VALUES ($1, $2)`,
+				"COMMIT",
+				"BEGIN",
+				"SELECT pg_advisory_xact_lock($1)",
+				migrationsTable,
+				`SELECT * FROM "app"."schema_migrations"`,
+				"COMMIT",
+			},
+		},
+		{
+			name:    "Revert",
+			applied: [][][]driver.Value{{{int64(1), "one", now}}, nil},
+			version: 0,
+			expected: []string{
+				"BEGIN",
+				"SELECT pg_advisory_xact_lock($1)",
+				migrationsTable,
+				`SELECT * FROM "app"."schema_migrations"`,
+				"DROP TABLE one;",
+				`DELETE FROM "app"."schema_migrations" WHERE ("version" = $1)`,
+				"COMMIT",
+				"BEGIN",
+				"SELECT pg_advisory_xact_lock($1)",
+				migrationsTable,
+				`SELECT * FROM "app"."schema_migrations"`,
+				"COMMIT",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// each reply answers a single read of the migrations table
+			var replies []reply
+			for _, rows := range tt.applied {
+				replies = append(replies, reply{contains: `FROM "app"."schema_migrations"`, columns: migrationColumns, rows: rows, times: 1})
+			}
+
+			rec, sess := newRecorder(t, replies...)
+
+			m, err := NewMigrator(sess, migrationFiles, MigrationsTable("app.schema_migrations"), MigrationsLock(42))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.MigrateTo(context.Background(), tt.version); err != nil {
+				t.Fatal(err)
+			}
+
+			got := recordedTx(rec)
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			locks := rec.arguments("pg_advisory_xact_lock")
+			if len(locks) != len(tt.applied) {
+				t.Errorf("%s: expecting %d locks, got %d", tt.name, len(tt.applied), len(locks))
+			}
+
+			for _, args := range locks {
+				if !cmp.Equal([]driver.Value{int64(42)}, args) {
+					t.Errorf("%s: expecting the lock 42, got %v", tt.name, args)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	rec, sess := newRecorder(t)
+
+	var out bytes.Buffer
+	m, err := NewMigrator(sess, migrationFiles, MigrationsTable("app.schema_migrations"), DryRun(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"BEGIN",
+		"SELECT pg_advisory_xact_lock($1)",
+		migrationsTable,
+		`SELECT * FROM "app"."schema_migrations"`,
+		"ROLLBACK",
+	}
+
+	if got := recordedTx(rec); !cmp.Equal(expected, got) {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+
+	for _, step := range []string{"-- 1_one.up\nCREATE TABLE one", "-- 2_two.up\nCREATE TABLE two"} {
+		if !strings.Contains(out.String(), step) {
+			t.Errorf("expecting the dry run to write %q, got %q", step, out.String())
+		}
+	}
+}
+
+func TestMigrationStatus(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		exists   bool
+		expected []bool
+	}{
+		{
+			name:     "Missing migrations table",
+			expected: []bool{false, false},
+		},
+		{
+			name:     "Applied migrations",
+			exists:   true,
+			expected: []bool{true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, sess := newRecorder(t,
+				reply{contains: "to_regclass", columns: []string{"exists"}, rows: [][]driver.Value{{tt.exists}}},
+				reply{contains: `FROM "app"."schema_migrations"`, columns: migrationColumns, rows: [][]driver.Value{{int64(1), "one", now}}},
+			)
+
+			m, err := NewMigrator(sess, migrationFiles, MigrationsTable("app.schema_migrations"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, err := m.Status(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []bool
+			for _, s := range status {
+				got = append(got, s.Applied)
+			}
+
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			expected := [][]driver.Value{{`"app"."schema_migrations"`}}
+			if args := rec.arguments("to_regclass"); !cmp.Equal(expected, args) {
+				t.Errorf("%s: expecting the quoted table, got %v", tt.name, args)
+			}
+
+			for _, statement := range []string{"BEGIN", "pg_advisory_xact_lock", "CREATE TABLE"} {
+				if got := rec.matching(statement); len(got) > 0 {
+					t.Errorf("%s: expecting a plain read, got %v", tt.name, got)
+				}
+			}
+		})
+	}
+}
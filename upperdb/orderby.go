@@ -0,0 +1,80 @@
+package upperdb
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+
+	"github.com/mishudark/errors"
+)
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// sortColumns parses an order_by string as defined in https://google.aip.dev/132, e.g.
+//
+//	display_name desc, quantity
+//
+// each field can be referenced by its db column or by its struct field name, and it is
+// ascending unless it has the desc suffix. The primary key is added as tie-breaker when
+// it is not part of the order. The nullable fields, pointers or sql.Scanner types like
+// sql.NullString, are rejected, since the page tokens can not select the rows after a NULL
+func (p *PartialMutation) sortColumns(orderBy string) ([]sortColumn, error) {
+	if _, ok := p.columnsMap[p.primaryKey]; !ok {
+		return nil, errors.E(errors.Errorf("primary key %s is not a field of %T", p.primaryKey, p.structValue), errors.Internal)
+	}
+
+	var columns []sortColumn
+	seen := make(map[string]bool)
+
+	if strings.TrimSpace(orderBy) != "" {
+		for _, part := range strings.Split(orderBy, ",") {
+			words := strings.Fields(part)
+			if len(words) == 0 || len(words) > 2 {
+				return nil, errors.E(errors.Errorf("invalid order_by: %q", orderBy), errors.Invalid)
+			}
+
+			column, fieldType, ok := p.resolveField(words[0])
+			if !ok {
+				return nil, errors.E(errors.Errorf("invalid order_by, unknown field %s", words[0]), errors.Invalid)
+			}
+
+			if column != p.primaryKey && nullable(fieldType) {
+				return nil, errors.E(errors.Errorf("invalid order_by, field %s is nullable", words[0]), errors.Invalid)
+			}
+
+			if seen[column] {
+				return nil, errors.E(errors.Errorf("invalid order_by, duplicated field %s", words[0]), errors.Invalid)
+			}
+			seen[column] = true
+
+			desc := false
+			if len(words) == 2 {
+				switch words[1] {
+				case "asc":
+				case "desc":
+					desc = true
+				default:
+					return nil, errors.E(errors.Errorf("invalid order_by, unknown direction %s for field %s", words[1], words[0]), errors.Invalid)
+				}
+			}
+
+			columns = append(columns, sortColumn{column: column, desc: desc})
+		}
+	}
+
+	if !seen[p.primaryKey] {
+		columns = append(columns, sortColumn{column: p.primaryKey})
+	}
+
+	return columns, nil
+}
+
+// nullable tells if the values of the given type can be NULL
+func nullable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return true
+	}
+
+	return reflect.PtrTo(t).Implements(scannerType)
+}
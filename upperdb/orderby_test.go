@@ -0,0 +1,101 @@
+package upperdb
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+)
+
+type orderResource struct {
+	ID          string         `db:"id"`
+	Name        string         `db:"name"`
+	DisplayName string         `db:"display_name"`
+	Quantity    int            `db:"quantity"`
+	Nickname    *string        `db:"nickname"`
+	Code        sql.NullString `db:"code"`
+}
+
+func TestSortColumns(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(orderResource{}),
+		Include([]string{"Name"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		given    string
+		expected []string
+	}{
+		{
+			name:     "Empty order",
+			given:    "",
+			expected: []string{"id"},
+		},
+		{
+			name:     "Mixed directions",
+			given:    "display_name desc, quantity",
+			expected: []string{"display_name desc", "quantity", "id"},
+		},
+		{
+			name:     "Struct field names",
+			given:    "Quantity asc,DisplayName desc",
+			expected: []string{"quantity", "display_name desc", "id"},
+		},
+		{
+			name:     "Primary key is not repeated",
+			given:    "id desc",
+			expected: []string{"id desc"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, err := mut.sortColumns(tt.given)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, c := range columns {
+				if c.desc {
+					got = append(got, c.column+" desc")
+					continue
+				}
+
+				got = append(got, c.column)
+			}
+
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestSortColumnsInvalid(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(orderResource{}),
+		Include([]string{"Name"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, given := range []string{"country", "name up", "name,,quantity", "name desc, name", "name desc quantity", "nickname", "Code desc"} {
+		if _, err := mut.sortColumns(given); !errors.IsKind(err, errors.Invalid) {
+			t.Errorf("%q: expecting an invalid error, got %v", given, err)
+		}
+	}
+}
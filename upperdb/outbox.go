@@ -0,0 +1,291 @@
+package upperdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// Operations of the events written to the outbox
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventUpsert = "upsert"
+)
+
+// Event is a change of a resource, it is written to the outbox in the same transaction as
+// the change, and it is handed to a Publisher by the Relay
+type Event struct {
+	ID            int64           `json:"id"`
+	ResourceType  string          `json:"resource_type"`
+	ResourceKey   string          `json:"resource_key"`
+	Operation     string          `json:"operation"`
+	ChangedFields []string        `json:"changed_fields"`
+	Payload       json.RawMessage `json:"payload"`
+	CreateTime    time.Time       `json:"create_time"`
+}
+
+// outboxRow is an Event as it is stored in the outbox table
+type outboxRow struct {
+	ID            int64     `db:"id,omitempty"`
+	ResourceType  string    `db:"resource_type"`
+	ResourceKey   string    `db:"resource_key"`
+	Operation     string    `db:"operation"`
+	ChangedFields []byte    `db:"changed_fields"`
+	Payload       []byte    `db:"payload"`
+	CreateTime    time.Time `db:"create_time"`
+}
+
+// Outbox enables the transactional outbox, Insert, InsertMany, Upsert and Update write an Event
+// of the given resource type into the outbox table, in the same transaction as the change, a
+// transaction is started when the session is not one. The outbox table is expected to be
+//
+//	CREATE TABLE outbox (
+//		id             BIGSERIAL PRIMARY KEY,
+//		resource_type  TEXT NOT NULL,
+//		resource_key   TEXT NOT NULL,
+//		operation      TEXT NOT NULL,
+//		changed_fields JSONB NOT NULL,
+//		payload        JSONB NOT NULL,
+//		create_time    TIMESTAMPTZ NOT NULL
+//	);
+func Outbox(table, resourceType string) Option {
+	return func(op *PartialMutation) {
+		op.outboxTable = table
+		op.resourceType = resourceType
+	}
+}
+
+// inOutboxTx runs fn in a transaction when the outbox is enabled and sess is not already one,
+// so the change and its event are committed together
+func (p *PartialMutation) inOutboxTx(ctx context.Context, sess sqlbuilder.SQLBuilder, fn func(sess sqlbuilder.SQLBuilder) error) error {
+	database, ok := sess.(sqlbuilder.Database)
+	if p.outboxTable == "" || !ok {
+		return fn(sess)
+	}
+
+	return RunInTx(ctx, database, nil, func(tx sqlbuilder.Tx) error {
+		return fn(tx)
+	})
+}
+
+// newEvent builds the event of a written row, the resource key is the primary key of the row
+// when it is a field, otherwise it is whereValue
+func (p *PartialMutation) newEvent(operation string, structPtr interface{}, columns []string, whereValue string) (Event, error) {
+	payload, err := json.Marshal(structPtr)
+	if err != nil {
+		return Event{}, errors.E(err, "outbox, invalid payload", errors.Internal)
+	}
+
+	key := whereValue
+	if field, ok := p.columnsMap[p.primaryKey]; ok {
+		mapValues, err := p.fieldValues(structPtr)
+		if err != nil {
+			return Event{}, err
+		}
+
+		key = fmt.Sprint(mapValues[field])
+	}
+
+	changedFields := append([]string{}, columns...)
+	sort.Strings(changedFields)
+
+	return Event{
+		ResourceType:  p.resourceType,
+		ResourceKey:   key,
+		Operation:     operation,
+		ChangedFields: changedFields,
+		Payload:       payload,
+		CreateTime:    p.clock(),
+	}, nil
+}
+
+// writeEvents writes the events into the outbox table, it does nothing when the outbox is disabled
+func (p *PartialMutation) writeEvents(ctx context.Context, sess sqlbuilder.SQLBuilder, events ...Event) error {
+	if p.outboxTable == "" || len(events) == 0 {
+		return nil
+	}
+
+	columns := []string{"resource_type", "resource_key", "operation", "changed_fields", "payload", "create_time"}
+	chunkSize := maxParameters / len(columns)
+	for start := 0; start < len(events); start += chunkSize {
+		end := start + chunkSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		query := sess.InsertInto(p.outboxTable).Columns(columns...)
+		for _, event := range events[start:end] {
+			changedFields, err := json.Marshal(event.ChangedFields)
+			if err != nil {
+				return errors.E(err, "outbox, invalid changed fields", errors.Internal)
+			}
+
+			query = query.Values(event.ResourceType, event.ResourceKey, event.Operation, string(changedFields), string(event.Payload), event.CreateTime)
+		}
+
+		if _, err := query.ExecContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Publisher publishes the events of the outbox, the events are removed from the outbox only when
+// Publish returns nil, so they are delivered at least once
+type Publisher interface {
+	Publish(ctx context.Context, events []Event) error
+}
+
+// PublisherFunc is an adapter to use an ordinary function as Publisher
+type PublisherFunc func(ctx context.Context, events []Event) error
+
+// Publish calls f(ctx, events)
+func (f PublisherFunc) Publish(ctx context.Context, events []Event) error {
+	return f(ctx, events)
+}
+
+// Relay moves the events from the outbox table to a Publisher, many relays can run at the same
+// time, since the events are locked with FOR UPDATE SKIP LOCKED
+type Relay struct {
+	sess         sqlbuilder.Database
+	table        string
+	publisher    Publisher
+	batchSize    int
+	pollInterval time.Duration
+	onError      func(error)
+}
+
+// RelayOption defines an option that changes the values of Relay struct
+type RelayOption func(r *Relay)
+
+// BatchSize set the maximum number of events handed to the publisher at once, 100 by default
+func BatchSize(size int) RelayOption {
+	return func(r *Relay) {
+		r.batchSize = size
+	}
+}
+
+// PollInterval set the wait between polls when the outbox is empty, a second by default
+func PollInterval(interval time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.pollInterval = interval
+	}
+}
+
+// OnError set a function that receives the errors of Run, the relay keeps running after them
+func OnError(fn func(error)) RelayOption {
+	return func(r *Relay) {
+		r.onError = fn
+	}
+}
+
+// NewRelay returns a Relay of the given outbox table
+func NewRelay(sess sqlbuilder.Database, table string, publisher Publisher, opts ...RelayOption) (*Relay, error) {
+	r := &Relay{
+		sess:         sess,
+		table:        table,
+		publisher:    publisher,
+		batchSize:    100,
+		pollInterval: time.Second,
+		onError:      func(error) {},
+	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	if r.sess == nil || r.table == "" || r.publisher == nil {
+		return nil, errors.E(errors.New("Relay, session, table and publisher are required"), errors.Invalid)
+	}
+
+	if r.batchSize <= 0 || r.pollInterval <= 0 {
+		return nil, errors.E(errors.New("Relay, batch size and poll interval must be positive"), errors.Invalid)
+	}
+
+	return r, nil
+}
+
+// Run relays the events until ctx is done, the errors are passed to the OnError function
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil {
+			r.onError(err)
+		}
+
+		// a full batch means that there can be more events waiting
+		if err == nil && n == r.batchSize {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// RelayOnce publishes a batch of events in the order they were written, and removes them from
+// the outbox, it returns the number of published events
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	var n int
+
+	err := RunInTx(ctx, r.sess, nil, func(tx sqlbuilder.Tx) error {
+		var rows []outboxRow
+		err := tx.SelectFrom(r.table).OrderBy("id").Limit(r.batchSize).Amend(func(query string) string {
+			return query + " FOR UPDATE SKIP LOCKED"
+		}).IteratorContext(ctx).All(&rows)
+		if err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		events := make([]Event, len(rows))
+		ids := make([]interface{}, len(rows))
+		for i, row := range rows {
+			events[i] = Event{
+				ID:           row.ID,
+				ResourceType: row.ResourceType,
+				ResourceKey:  row.ResourceKey,
+				Operation:    row.Operation,
+				Payload:      json.RawMessage(row.Payload),
+				CreateTime:   row.CreateTime,
+			}
+
+			if err := json.Unmarshal(row.ChangedFields, &events[i].ChangedFields); err != nil {
+				return errors.E(err, fmt.Sprintf("outbox, invalid changed fields of event %d", row.ID), errors.Unmarshal)
+			}
+
+			ids[i] = row.ID
+		}
+
+		if err := r.publisher.Publish(ctx, events); err != nil {
+			return err
+		}
+
+		if _, err := tx.DeleteFrom(r.table).Where(db.Cond{"id IN": ids}).ExecContext(ctx); err != nil {
+			return err
+		}
+
+		n = len(rows)
+		return nil
+	})
+
+	return n, err
+}
@@ -0,0 +1,311 @@
+package upperdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+type outboxResource struct {
+	ID   int    `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+}
+
+func TestNewEvent(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	mut, err := NewPartialMutation(
+		Values(outboxResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+		Outbox("outbox", "Resource"),
+		Clock(func() time.Time { return now }),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := mut.newEvent(EventUpdate, &outboxResource{ID: 7, Name: "CAN"}, []string{"name", "id"}, "CAN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Event{
+		ResourceType:  "Resource",
+		ResourceKey:   "7",
+		Operation:     EventUpdate,
+		ChangedFields: []string{"id", "name"},
+		Payload:       json.RawMessage(`{"id":7,"name":"CAN"}`),
+		CreateTime:    now,
+	}
+
+	if equal := cmp.Equal(expected, got); !equal {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+}
+
+func TestInOutboxTx(t *testing.T) {
+	var tests = []struct {
+		name     string
+		outbox   bool
+		expected []string
+	}{
+		{
+			name:     "Outbox disabled",
+			expected: nil,
+		},
+		{
+			name:     "Outbox enabled",
+			outbox:   true,
+			expected: []string{"BEGIN", "COMMIT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := &txDatabaseMock{}
+			mut := &PartialMutation{}
+			if tt.outbox {
+				mut.outboxTable = "outbox"
+			}
+
+			err := mut.inOutboxTx(context.Background(), sess, func(s sqlbuilder.SQLBuilder) error {
+				if _, isTx := s.(sqlbuilder.Tx); isTx != tt.outbox {
+					t.Errorf("%s: expecting a transaction %v, got %T", tt.name, tt.outbox, s)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if equal := cmp.Equal(tt.expected, sess.log); !equal {
+				diff := cmp.Diff(tt.expected, sess.log)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestNewRelay(t *testing.T) {
+	publisher := PublisherFunc(func(ctx context.Context, events []Event) error { return nil })
+
+	if _, err := NewRelay(&databaseMock{}, "outbox", publisher); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, err := NewRelay(&databaseMock{}, "", publisher); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error without table, got %v", err)
+	}
+
+	if _, err := NewRelay(&databaseMock{}, "outbox", publisher, BatchSize(0)); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error with zero batch size, got %v", err)
+	}
+}
+
+func TestOutboxWrites(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	row := []driver.Value{int64(1), "CAN"}
+
+	var tests = []struct {
+		name      string
+		reply     reply
+		write     func(mut *PartialMutation, sess sqlbuilder.Database) error
+		statement string
+		expected  [][]driver.Value
+	}{
+		{
+			name:  "Insert",
+			reply: reply{contains: `INSERT INTO "resources"`, rows: [][]driver.Value{row}},
+			write: func(mut *PartialMutation, sess sqlbuilder.Database) error {
+				return mut.Insert(sess, &outboxResource{Name: "CAN"}, "id", "", nil)
+			},
+			statement: `INSERT INTO "resources" ("name") VALUES ($1) RETURNING *`,
+			expected:  [][]driver.Value{{"Resource", "1", EventCreate, `["name"]`, `{"id":1,"name":"CAN"}`, now}},
+		},
+		{
+			name:  "InsertMany",
+			reply: reply{contains: `INSERT INTO "resources"`, rows: [][]driver.Value{row, {int64(2), "MEX"}}},
+			write: func(mut *PartialMutation, sess sqlbuilder.Database) error {
+				return mut.InsertMany(sess, &[]outboxResource{{Name: "CAN"}, {Name: "MEX"}}, nil)
+			},
+			statement: `INSERT INTO "resources" ("name") VALUES ($1), ($2) RETURNING *`,
+			expected: [][]driver.Value{{
+				"Resource", "1", EventCreate, `["name"]`, `{"id":1,"name":"CAN"}`, now,
+				"Resource", "2", EventCreate, `["name"]`, `{"id":2,"name":"MEX"}`, now,
+			}},
+		},
+		{
+			name:  "Upsert",
+			reply: reply{contains: `INSERT INTO "resources"`, rows: [][]driver.Value{row}},
+			write: func(mut *PartialMutation, sess sqlbuilder.Database) error {
+				return mut.Upsert(sess, &outboxResource{Name: "CAN"}, "CAN", nil)
+			},
+			statement: `INSERT INTO "resources" ("name") VALUES ($1) ON CONFLICT ("name") DO UPDATE SET "name" = EXCLUDED."name" RETURNING *`,
+			expected:  [][]driver.Value{{"Resource", "1", EventUpsert, `["name"]`, `{"id":1,"name":"CAN"}`, now}},
+		},
+		{
+			name:  "Update",
+			reply: reply{contains: `UPDATE "resources"`, rows: [][]driver.Value{row}},
+			write: func(mut *PartialMutation, sess sqlbuilder.Database) error {
+				return mut.Update(sess, &outboxResource{Name: "CAN"}, "id", "1", []string{"Name"}, nil)
+			},
+			statement: `UPDATE "resources" SET "name" = $1 WHERE ("id" = $2) RETURNING *`,
+			expected:  [][]driver.Value{{"Resource", "1", EventUpdate, `["name"]`, `{"id":1,"name":"CAN"}`, now}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.reply.columns = []string{"id", "name"}
+			rec, sess := newRecorder(t, tt.reply)
+			defer ClearCache()
+
+			mut, err := NewPartialMutation(
+				Values(outboxResource{}),
+				Exclude([]string{"ID"}),
+				Table("resources"),
+				ConflictColumns([]string{"name"}),
+				Session(sess),
+				Outbox("outbox", "Resource"),
+				Clock(func() time.Time { return now }),
+			)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.write(mut, sess); err != nil {
+				t.Fatal(err)
+			}
+
+			// the change and its events are committed together
+			expected := []string{
+				"BEGIN",
+				tt.statement,
+				`INSERT INTO "outbox" ("resource_type", "resource_key", "operation", "changed_fields", "payload", "create_time") ` +
+					`VALUES ` + outboxValues(len(tt.expected[0])/6),
+				"COMMIT",
+			}
+
+			if got := recordedTx(rec); !cmp.Equal(expected, got) {
+				diff := cmp.Diff(expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			if got := rec.arguments(`INSERT INTO "outbox"`); !cmp.Equal(tt.expected, got) {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+// outboxValues returns the VALUES of an insert of n events into the outbox
+func outboxValues(n int) string {
+	var values []string
+	for i := 0; i < n; i++ {
+		var placeholders []string
+		for j := 1; j <= 6; j++ {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", i*6+j))
+		}
+
+		values = append(values, "("+strings.Join(placeholders, ", ")+")")
+	}
+
+	return strings.Join(values, ", ")
+}
+
+func TestRelayOnce(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	published := errors.New("publish failed")
+
+	var tests = []struct {
+		name     string
+		err      error
+		expected []string
+		n        int
+	}{
+		{
+			name: "Published",
+			expected: []string{
+				"BEGIN",
+				`SELECT * FROM "outbox" ORDER BY "id" ASC LIMIT 10 FOR UPDATE SKIP LOCKED`,
+				`DELETE FROM "outbox" WHERE ("id" IN ($1, $2))`,
+				"COMMIT",
+			},
+			n: 2,
+		},
+		{
+			name: "Publish failed",
+			err:  published,
+			expected: []string{
+				"BEGIN",
+				`SELECT * FROM "outbox" ORDER BY "id" ASC LIMIT 10 FOR UPDATE SKIP LOCKED`,
+				"ROLLBACK",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, sess := newRecorder(t, reply{
+				contains: `FROM "outbox"`,
+				columns:  []string{"id", "resource_type", "resource_key", "operation", "changed_fields", "payload", "create_time"},
+				rows: [][]driver.Value{
+					{int64(3), "Resource", "1", EventCreate, []byte(`["name"]`), []byte(`{"id":1}`), now},
+					{int64(4), "Resource", "1", EventUpdate, []byte(`["name"]`), []byte(`{"id":1}`), now},
+				},
+			})
+
+			var events []Event
+			publisher := PublisherFunc(func(ctx context.Context, e []Event) error {
+				events = e
+				return tt.err
+			})
+
+			relay, err := NewRelay(sess, "outbox", publisher, BatchSize(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := relay.RelayOnce(context.Background())
+			if errors.Cause(err) != tt.err || n != tt.n {
+				t.Errorf("%s: expecting %d events and the error %v, got %d and %v", tt.name, tt.n, tt.err, n, err)
+			}
+
+			if got := recordedTx(rec); !cmp.Equal(tt.expected, got) {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			expected := []Event{
+				{ID: 3, ResourceType: "Resource", ResourceKey: "1", Operation: EventCreate, ChangedFields: []string{"name"}, Payload: json.RawMessage(`{"id":1}`), CreateTime: now},
+				{ID: 4, ResourceType: "Resource", ResourceKey: "1", Operation: EventUpdate, ChangedFields: []string{"name"}, Payload: json.RawMessage(`{"id":1}`), CreateTime: now},
+			}
+
+			if equal := cmp.Equal(expected, events); !equal {
+				diff := cmp.Diff(expected, events)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			if tt.err == nil {
+				if args := rec.arguments("DELETE"); !cmp.Equal([][]driver.Value{{int64(3), int64(4)}}, args) {
+					t.Errorf("%s: expecting the published events to be deleted, got %v", tt.name, args)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package upperdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+)
+
+// sortColumn is a column used to sort a List, the last sort column of a List is
+// always the primary key, it works as tie-breaker for non unique columns
+type sortColumn struct {
+	column string
+	desc   bool
+}
+
+// cursor is the content of an opaque page token, it holds the values of the sort
+// columns of the last row returned, and the checksum of the request that created it
+type cursor struct {
+	Values   []interface{} `json:"v"`
+	Checksum string        `json:"c"`
+}
+
+// encodePageToken serializes the token as url safe base64, if secret is not empty
+// the token is signed with HMAC-SHA256
+func encodePageToken(token cursor, secret []byte) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", errors.E(err, "encodePageToken", errors.Internal)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	if len(secret) == 0 {
+		return encoded, nil
+	}
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signPageToken(payload, secret)), nil
+}
+
+// decodePageToken parses a token created by encodePageToken, if secret is not empty
+// the signature is required and verified
+func decodePageToken(token string, secret []byte) (cursor, error) {
+	var decoded cursor
+
+	parts := strings.Split(token, ".")
+	if len(parts) > 2 || (len(secret) > 0 && len(parts) != 2) || (len(secret) == 0 && len(parts) != 1) {
+		return decoded, errors.E(errors.New("invalid page token"), errors.Invalid)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return decoded, errors.E(errors.New("invalid page token"), errors.Invalid)
+	}
+
+	if len(secret) > 0 {
+		signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || !hmac.Equal(signature, signPageToken(payload, secret)) {
+			return decoded, errors.E(errors.New("invalid page token signature"), errors.Invalid)
+		}
+	}
+
+	// numbers are kept as json.Number to avoid losing precision in big integers
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return decoded, errors.E(errors.New("invalid page token"), errors.Invalid)
+	}
+
+	return decoded, nil
+}
+
+func signPageToken(payload, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+// requestChecksum identifies the filter, the order and the deleted rows of a List request, a
+// page token can only be used with the same request that created it
+func requestChecksum(columns []sortColumn, where map[string]string, filter string, showDeleted bool) string {
+	h := sha256.New()
+	for _, c := range columns {
+		fmt.Fprintf(h, "order:%q:%t;", c.column, c.desc)
+	}
+
+	keys := make([]string, 0, len(where))
+	for k := range where {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(h, "where:%q:%q;", k, where[k])
+	}
+
+	fmt.Fprintf(h, "filter:%q;", filter)
+
+	// only written when it is set, so the tokens issued without it are still valid
+	if showDeleted {
+		fmt.Fprint(h, "deleted;")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// keysetCondition returns the condition that selects the rows after the given values,
+// for the columns (a, b, c) it is expanded as:
+// a > va OR (a = va AND b > vb) OR (a = va AND b = vb AND c > vc)
+// using < instead of > for descending columns
+func keysetCondition(columns []sortColumn, values []interface{}) db.Compound {
+	var conds []db.Compound
+	for i := range columns {
+		var and []db.Compound
+		for j := 0; j < i; j++ {
+			and = append(and, db.Cond{columns[j].column: db.Eq(values[j])})
+		}
+
+		if columns[i].desc {
+			and = append(and, db.Cond{columns[i].column: db.Lt(values[i])})
+		} else {
+			and = append(and, db.Cond{columns[i].column: db.Gt(values[i])})
+		}
+
+		conds = append(conds, db.And(and...))
+	}
+
+	return db.Or(conds...)
+}
+
+// orderByColumns returns the sort columns in the format expected by db.Result.OrderBy
+func orderByColumns(columns []sortColumn) []interface{} {
+	order := make([]interface{}, len(columns))
+	for i, c := range columns {
+		if c.desc {
+			order[i] = "-" + c.column
+			continue
+		}
+
+		order[i] = c.column
+	}
+
+	return order
+}
@@ -0,0 +1,135 @@
+package upperdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+)
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	var tests = []struct {
+		name   string
+		secret []byte
+	}{
+		{
+			name: "Unsigned",
+		},
+		{
+			name:   "Signed",
+			secret: []byte("secret"),
+		},
+	}
+
+	given := cursor{
+		Values:   []interface{}{"Canada", 9007199254740993},
+		Checksum: "checksum",
+	}
+
+	expected := cursor{
+		Values:   []interface{}{"Canada", json.Number("9007199254740993")},
+		Checksum: "checksum",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := encodePageToken(given, tt.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := decodePageToken(token, tt.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if equal := cmp.Equal(expected, got); !equal {
+				diff := cmp.Diff(expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestPageTokenRejected(t *testing.T) {
+	signed, err := encodePageToken(cursor{Values: []interface{}{"CAN"}}, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := encodePageToken(cursor{Values: []interface{}{"CAN"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name   string
+		token  string
+		secret []byte
+	}{
+		{
+			name:   "Wrong secret",
+			token:  signed,
+			secret: []byte("other"),
+		},
+		{
+			name:   "Missing signature",
+			token:  unsigned,
+			secret: []byte("secret"),
+		},
+		{
+			name:   "Altered payload",
+			token:  "x" + signed,
+			secret: []byte("secret"),
+		},
+		{
+			name:  "Not base64",
+			token: "***",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodePageToken(tt.token, tt.secret)
+			if !errors.IsKind(err, errors.Invalid) {
+				t.Errorf("%s: expecting an invalid error, got %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestRequestChecksum(t *testing.T) {
+	columns := []sortColumn{{column: "name"}, {column: "id"}}
+	where := map[string]string{"quantity": "3", "display_name": "Canada"}
+
+	if requestChecksum(columns, where, "", false) != requestChecksum(columns, map[string]string{"display_name": "Canada", "quantity": "3"}, "", false) {
+		t.Error("same request must have the same checksum")
+	}
+
+	if requestChecksum(columns, where, "", false) == requestChecksum(columns, map[string]string{"quantity": "3"}, "", false) {
+		t.Error("different where values must have a different checksum")
+	}
+
+	if requestChecksum(columns, where, "", false) == requestChecksum(columns, where, "quantity > 3", false) {
+		t.Error("different filter must have a different checksum")
+	}
+
+	if requestChecksum(columns, where, "", false) == requestChecksum([]sortColumn{{column: "name", desc: true}, {column: "id"}}, where, "", false) {
+		t.Error("different order must have a different checksum")
+	}
+
+	if requestChecksum(columns, where, "", false) == requestChecksum(columns, where, "", true) {
+		t.Error("showing the deleted rows must have a different checksum")
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	columns := []sortColumn{{column: "display_name", desc: true}, {column: "quantity"}, {column: "id"}}
+	values := []interface{}{"Canada", 3, "abc"}
+
+	expected := "((display_name < Canada) OR (display_name = Canada AND quantity > 3) OR (display_name = Canada AND quantity = 3 AND id > abc))"
+	if got := renderCondition(keysetCondition(columns, values)); got != expected {
+		t.Errorf("got %s, want %s", got, expected)
+	}
+}
@@ -1,11 +1,13 @@
 package upperdb
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
-	"github.com/fatih/structs"
 	validation "github.com/go-ozzo/ozzo-validation"
 	"github.com/mishudark/errors"
 	db "upper.io/db.v3"
@@ -15,19 +17,37 @@ import (
 // PartialMutation defines a custom
 type PartialMutation struct {
 	structValue         interface{}
+	structType          reflect.Type
+	fields              map[string]structField
 	includeFields       []string
 	excludeFields       []string
 	includeUpdateFields []string
 	excludeUpdateFields []string
 	fieldsMap           map[string]string
+	columnsMap          map[string]string
 	table               string
+	primaryKey          string
+	pageTokenSecret     []byte
+	softDeleteColumn    string
+	versionColumn       string
+	unversionedUpdates  bool
+	conflictColumns     []string
+	autoCreateColumns   []string
+	autoUpdateColumns   []string
+	clock               func() time.Time
+	outboxTable         string
+	resourceType        string
+	tenantColumn        string
+	replicas            *ReplicaPool
+	chunkParameters     int
 	col                 DbCollection
 	sess                sqlbuilder.Database
 }
 
 func validatePartialMutation(op *PartialMutation) error {
 	return validation.ValidateStruct(op,
-		validation.Field(&op.structValue, validation.Required),
+		// the resources that implement validation.Validatable are validated when they are written
+		validation.Field(&op.structValue, validation.Required, validation.Skip),
 		validation.Field(&op.table, validation.Required),
 		validation.Field(&op.sess, validation.Required),
 		validation.Field(&op.includeFields, validation.By(func(value interface{}) error {
@@ -96,9 +116,78 @@ func Table(table string) Option {
 	}
 }
 
+// SoftDelete enables the soft delete mode, Delete will stamp the given column (e.g. delete_time)
+// instead of removing the row, and List will hide the stamped rows
+func SoftDelete(column string) Option {
+	return func(op *PartialMutation) {
+		op.softDeleteColumn = column
+	}
+}
+
+// PrimaryKey set the unique column used as tie-breaker to paginate List results, by default it is
+// the id column
+func PrimaryKey(column string) Option {
+	return func(op *PartialMutation) {
+		op.primaryKey = column
+	}
+}
+
+// PageTokenSecret set the secret used to sign the page tokens returned by List, signed tokens can
+// not be forged or altered by the clients
+func PageTokenSecret(secret []byte) Option {
+	return func(op *PartialMutation) {
+		op.pageTokenSecret = secret
+	}
+}
+
+// ConflictColumns set the columns of the unique constraint used by Upsert to detect an existing row
+func ConflictColumns(columns []string) Option {
+	return func(op *PartialMutation) {
+		op.conflictColumns = columns
+	}
+}
+
+// ListOption defines an option that changes the behavior of a single List call
+type ListOption func(opts *listOptions)
+
+type listOptions struct {
+	showDeleted bool
+	filter      string
+	totalSize   TotalSizeMode
+}
+
+// ListResult is a page of results returned by List
+type ListResult struct {
+	// Items is the slice pointed by the container given to List
+	Items interface{}
+	// NextPageToken is empty on the last page
+	NextPageToken string
+	// TotalSize is the number of rows that match the request across all the pages, it is nil
+	// unless it is requested with TotalSize
+	TotalSize *int64
+}
+
+// ShowDeleted includes the soft deleted rows in the List results
+func ShowDeleted(show bool) ListOption {
+	return func(opts *listOptions) {
+		opts.showDeleted = show
+	}
+}
+
+// Filter restricts the List results with a filter expression, see ParseFilter
+func Filter(filter string) ListOption {
+	return func(opts *listOptions) {
+		opts.filter = filter
+	}
+}
+
 // NewPartialMutation returns a PartialMutation and uses a set of options to create it
 func NewPartialMutation(opt Option, opts ...Option) (*PartialMutation, error) {
-	operation := &PartialMutation{}
+	operation := &PartialMutation{
+		primaryKey:      "id",
+		clock:           time.Now,
+		chunkParameters: maxParameters,
+	}
 
 	opt(operation)
 	for _, o := range opts {
@@ -106,17 +195,22 @@ func NewPartialMutation(opt Option, opts ...Option) (*PartialMutation, error) {
 	}
 
 	if operation.structValue != nil {
-		operation.fieldsMap = make(map[string]string)
-		t := reflect.TypeOf(operation.structValue)
-		for i := 0; i < t.NumField(); i++ {
-			field := t.Field(i)
-			tag := field.Tag.Get("db")
-			if tag == "" || tag == "-" {
-				continue
-			}
+		fields, err := structFields(reflect.TypeOf(operation.structValue))
+		if err != nil {
+			return nil, err
+		}
+
+		operation.structType = reflect.TypeOf(operation.structValue)
+		for operation.structType.Kind() == reflect.Ptr {
+			operation.structType = operation.structType.Elem()
+		}
 
-			parts := strings.Split(tag, ",")
-			operation.fieldsMap[field.Name] = parts[0]
+		operation.fields = fields
+		operation.fieldsMap = make(map[string]string)
+		operation.columnsMap = make(map[string]string)
+		for name, field := range fields {
+			operation.fieldsMap[name] = field.column
+			operation.columnsMap[field.column] = name
 		}
 	}
 
@@ -125,113 +219,918 @@ func NewPartialMutation(opt Option, opts ...Option) (*PartialMutation, error) {
 		return nil, err
 	}
 
+	if err := operation.validateVersion(); err != nil {
+		return nil, err
+	}
+
+	if err := operation.validateTimestamps(); err != nil {
+		return nil, err
+	}
+
+	operation.validateTenant()
+
 	operation.col = Ensure(operation.sess, operation.table)
 	return operation, nil
 }
 
 // Insert the provided values with the included or exluded fields, include rules has preference over
 // the excluded rules
-// If sess is in transaction mode, the new values won't  be readed from the database
-func (p *PartialMutation) Insert(sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, extraFields map[string]interface{}) error {
+// structPtr is filled with the inserted row, including the values generated by the database
+// A unique violation is returned as errors.Duplicated, and the other constraint violations as
+// errors.Invalid, with the constraint, column and table names as metadata
+// If structPtr implements validation.Validatable, it is validated before writing, the failures
+// are returned as errors.Invalid with the message of each invalid field as metadata
+func (p *PartialMutation) Insert(sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(sessionContext(sess), p.table, "insert")
+	defer end(&err)
+
+	if err := p.validateResource("insert", structPtr, nil); err != nil {
+		return err
+	}
+
+	return p.inOutboxTx(ctx, sess, func(sess sqlbuilder.SQLBuilder) error {
+		return p.insert(ctx, sess, structPtr, whereColumn, whereValue, extraFields)
+	})
+}
+
+// InsertContext is like Insert, but the write is bound to the given context
+func (p *PartialMutation) InsertContext(ctx context.Context, sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(ctx, p.table, "insert")
+	defer end(&err)
+
+	if err := p.validateResource("insert", structPtr, nil); err != nil {
+		return err
+	}
+
+	return p.inOutboxTx(ctx, bindContext(ctx, sess), func(sess sqlbuilder.SQLBuilder) error {
+		return p.insert(ctx, sess, structPtr, whereColumn, whereValue, extraFields)
+	})
+}
+
+func (p *PartialMutation) insert(ctx context.Context, sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, extraFields map[string]interface{}) error {
 	if structPtr == nil || reflect.TypeOf(structPtr).Kind() != reflect.Ptr {
 		return fmt.Errorf("expecting a pointer but got %T", structPtr)
 	}
 
+	columns, values, err := p.insertColumnsValues(structPtr, extraFields)
+	if err != nil {
+		return err
+	}
+
+	columns, values, err = p.withTenant(ctx, "insert", columns, values)
+	if err != nil {
+		return err
+	}
+
+	query := sess.InsertInto(p.table).Columns(columns...).Values(values...).Returning("*")
+	err = query.IteratorContext(ctx).One(structPtr)
+	if err == db.ErrNoMoreRows {
+		return errors.E(errors.Errorf("operation insert can not be performed, zero rows affected, resource %s", whereValue), errors.NotExist)
+	}
+
+	if err != nil {
+		return translateError(err, "insert", whereValue)
+	}
+
+	if p.outboxTable == "" {
+		return nil
+	}
+
+	event, err := p.newEvent(EventCreate, structPtr, columns, whereValue)
+	if err != nil {
+		return err
+	}
+
+	return p.writeEvents(ctx, sess, event)
+}
+
+// maxParameters is the maximum number of bind parameters that Postgres accepts in a single statement
+const maxParameters = 65535
+
+// InsertMany inserts the elements of the provided slice pointer with the included or exluded fields,
+// the rows are written in chunks of a single statement each, which run in a transaction when sess
+// is a database, and the slice is filled back with the values generated by the database once every
+// chunk is written
+func (p *PartialMutation) InsertMany(sess sqlbuilder.SQLBuilder, slicePtr interface{}, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(sessionContext(sess), p.table, "insert_many")
+	defer end(&err)
+
+	if err := p.validateResources("insert_many", slicePtr); err != nil {
+		return err
+	}
+
+	return p.inOutboxTx(ctx, sess, func(sess sqlbuilder.SQLBuilder) error {
+		return p.insertMany(ctx, sess, slicePtr, extraFields)
+	})
+}
+
+// InsertManyContext is like InsertMany, but the writes are bound to the given context
+func (p *PartialMutation) InsertManyContext(ctx context.Context, sess sqlbuilder.SQLBuilder, slicePtr interface{}, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(ctx, p.table, "insert_many")
+	defer end(&err)
+
+	if err := p.validateResources("insert_many", slicePtr); err != nil {
+		return err
+	}
+
+	return p.inOutboxTx(ctx, bindContext(ctx, sess), func(sess sqlbuilder.SQLBuilder) error {
+		return p.insertMany(ctx, sess, slicePtr, extraFields)
+	})
+}
+
+func (p *PartialMutation) insertMany(ctx context.Context, sess sqlbuilder.SQLBuilder, slicePtr interface{}, extraFields map[string]interface{}) error {
+	if slicePtr == nil || reflect.TypeOf(slicePtr).Kind() != reflect.Ptr || reflect.TypeOf(slicePtr).Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("expecting a pointer to a slice but got %T", slicePtr)
+	}
+
+	items := reflect.ValueOf(slicePtr).Elem()
+	if items.Len() == 0 {
+		return nil
+	}
+
+	elemType := items.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
 	var (
-		columns []string
-		values  []interface{}
-		err     error
+		columns  []string
+		position map[string]int
+		rows     = make([][]interface{}, items.Len())
 	)
 
-	if len(p.includeFields) > 0 {
-		columns, values, err = p.getColumnsValuesIncluding(structPtr, p.includeFields)
+	for i := 0; i < items.Len(); i++ {
+		item := items.Index(i)
+		if !isPtr {
+			item = item.Addr()
+		} else if item.IsNil() {
+			return errors.E(errors.Errorf("operation insert many can not be performed, nil element at %d", i), errors.Invalid)
+		}
+
+		itemColumns, itemValues, err := p.insertColumnsValues(item.Interface(), extraFields)
+		if err != nil {
+			return err
+		}
+
+		itemColumns, itemValues, err = p.withTenant(ctx, "insert many", itemColumns, itemValues)
+		if err != nil {
+			return err
+		}
+
+		// the columns of the first element define the order of the values of every row
+		if columns == nil {
+			columns = itemColumns
+			position = make(map[string]int, len(columns))
+			for j, column := range columns {
+				position[column] = j
+			}
+		}
+
+		if len(itemColumns) != len(columns) {
+			return errors.New("columns and values length missmatch")
+		}
+
+		row := make([]interface{}, len(columns))
+		for j, column := range itemColumns {
+			k, ok := position[column]
+			if !ok {
+				return errors.E(errors.Errorf("insertMany operation, unexpected column: %s", column), errors.Internal)
+			}
+
+			row[k] = itemValues[j]
+		}
+
+		rows[i] = row
+	}
+
+	// each statement has at most chunkParameters bind parameters, maxParameters by default
+	chunkSize := p.chunkParameters / len(columns)
+	if chunkSize == 0 {
+		chunkSize = 1
+	}
+
+	var chunks []reflect.Value
+	insertChunks := func(sess sqlbuilder.SQLBuilder) error {
+		chunks = nil
+		for start := 0; start < len(rows); start += chunkSize {
+			end := start + chunkSize
+			if end > len(rows) {
+				end = len(rows)
+			}
+
+			query := sess.InsertInto(p.table).Columns(columns...)
+			for _, row := range rows[start:end] {
+				query = query.Values(row...)
+			}
+
+			inserted := reflect.New(reflect.SliceOf(elemType))
+			if err := query.Returning("*").IteratorContext(ctx).All(inserted.Interface()); err != nil {
+				return translateError(err, "insert many", fmt.Sprintf("%d to %d", start, end-1))
+			}
+
+			if inserted.Elem().Len() != end-start {
+				return errors.E(errors.Errorf("operation insert many, expecting %d rows but got %d", end-start, inserted.Elem().Len()), errors.Internal)
+			}
+
+			chunks = append(chunks, inserted.Elem())
+		}
+
+		return nil
+	}
+
+	// several chunks are written in a transaction, so a failed chunk does not leave the previous
+	// ones committed, unless sess is already a transaction
+	var err error
+	if database, ok := sess.(sqlbuilder.Database); ok && len(rows) > chunkSize {
+		err = RunInTx(ctx, database, nil, func(tx sqlbuilder.Tx) error {
+			return insertChunks(tx)
+		})
 	} else {
-		columns, values, err = p.getColumnsValuesExcluding(structPtr, p.excludeFields)
+		err = insertChunks(sess)
 	}
 
 	if err != nil {
 		return err
 	}
 
-	if extraFields != nil {
-		for k, v := range extraFields {
-			columns = append(columns, k)
-			values = append(values, v)
+	var (
+		events []Event
+		index  int
+	)
+
+	for _, inserted := range chunks {
+		for i := 0; i < inserted.Len(); i, index = i+1, index+1 {
+			item := items.Index(index)
+			if isPtr {
+				item = item.Elem()
+			}
+
+			item.Set(inserted.Index(i))
+
+			if p.outboxTable == "" {
+				continue
+			}
+
+			event, err := p.newEvent(EventCreate, item.Addr().Interface(), columns, "")
+			if err != nil {
+				return err
+			}
+
+			events = append(events, event)
 		}
 	}
 
-	lenColumns := len(columns)
-	lenValues := len(values)
-	if lenColumns == 0 || lenValues == 0 {
-		return errors.New("query with zero columns and values")
+	return p.writeEvents(ctx, sess, events...)
+}
+
+// Upsert inserts the provided values with the insert rules, if a row with the same conflict columns
+// already exists, it is updated using the update rules instead
+// structPtr is filled with the inserted or updated row, whereValue identifies the resource in the
+// errors, and in the outbox event when the primary key is not a field
+func (p *PartialMutation) Upsert(sess sqlbuilder.SQLBuilder, structPtr interface{}, whereValue string, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(sessionContext(sess), p.table, "upsert")
+	defer end(&err)
+
+	if err := p.validateResource("upsert", structPtr, nil); err != nil {
+		return err
 	}
 
-	if lenColumns != lenValues {
-		return errors.New("columns and values length missmatch")
+	return p.inOutboxTx(ctx, sess, func(sess sqlbuilder.SQLBuilder) error {
+		return p.upsert(ctx, sess, structPtr, whereValue, extraFields)
+	})
+}
+
+// UpsertContext is like Upsert, but the write is bound to the given context
+func (p *PartialMutation) UpsertContext(ctx context.Context, sess sqlbuilder.SQLBuilder, structPtr interface{}, whereValue string, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(ctx, p.table, "upsert")
+	defer end(&err)
+
+	if err := p.validateResource("upsert", structPtr, nil); err != nil {
+		return err
+	}
+
+	return p.inOutboxTx(ctx, bindContext(ctx, sess), func(sess sqlbuilder.SQLBuilder) error {
+		return p.upsert(ctx, sess, structPtr, whereValue, extraFields)
+	})
+}
+
+func (p *PartialMutation) upsert(ctx context.Context, sess sqlbuilder.SQLBuilder, structPtr interface{}, whereValue string, extraFields map[string]interface{}) error {
+	if structPtr == nil || reflect.TypeOf(structPtr).Kind() != reflect.Ptr {
+		return fmt.Errorf("expecting a pointer but got %T", structPtr)
 	}
 
-	query := sess.InsertInto(p.table).Columns(columns...).Values(values...)
-	res, err := query.Exec()
+	if len(p.conflictColumns) == 0 {
+		return errors.E(errors.New("operation upsert can not be performed, conflict columns are required"), errors.Invalid)
+	}
+
+	columns, values, err := p.insertColumnsValues(structPtr, extraFields)
 	if err != nil {
 		return err
 	}
 
-	if n, _ := res.RowsAffected(); n == 0 {
-		return errors.E(errors.Errorf("operation insert can not be performed, zero rows affected, resource %s", whereValue), errors.NotExist)
+	columns, values, err = p.withTenant(ctx, "upsert", columns, values)
+	if err != nil {
+		return err
+	}
+
+	updateColumns, _, err := p.updateColumnsValues(structPtr, nil, extraFields)
+	if err != nil {
+		return err
+	}
+
+	clause := p.onConflictClause(updateColumns)
+	query := sess.InsertInto(p.table).Columns(columns...).Values(values...).Amend(func(query string) string {
+		return query + " " + onConflictSQL(clause) + " RETURNING *"
+	})
+
+	err = query.IteratorContext(ctx).One(structPtr)
+	if err == db.ErrNoMoreRows {
+		return errors.E(errors.Errorf("operation upsert can not be performed, zero rows affected, resource %s", whereValue), errors.NotExist)
+	}
+
+	if err != nil {
+		return translateError(err, "upsert", whereValue)
 	}
 
-	if _, ok := sess.(sqlbuilder.Tx); ok {
+	if p.outboxTable == "" {
 		return nil
 	}
 
-	return p.col().Find(whereColumn, whereValue).Limit(1).One(structPtr)
+	event, err := p.newEvent(EventUpsert, structPtr, columns, whereValue)
+	if err != nil {
+		return err
+	}
+
+	return p.writeEvents(ctx, sess, event)
+}
+
+// conflictClause is an ON CONFLICT (columns) DO UPDATE clause, the inserted row is the EXCLUDED row
+type conflictClause struct {
+	table   string
+	columns []string
+	// excluded are the columns set to the value of the inserted row
+	excluded []string
+	// increment are the columns incremented by one, e.g. an integer version
+	increment []string
+	// where are the columns of the existing row that must be equal to the ones of the inserted
+	// row, otherwise the existing row is not updated nor returned
+	where []string
+}
+
+// onConflictClause builds the ON CONFLICT clause of an upsert, the conflict columns are never
+// updated, since they are the identity of the row, the version is updated when there is at least
+// one column to update. When there is nothing to update, the first conflict column is set to
+// itself, so the existing row is still returned by RETURNING
+// If multi-tenancy is enabled, a conflict with a row of another tenant returns no row instead of
+// changing it
+func (p *PartialMutation) onConflictClause(updateColumns []string) conflictClause {
+	clause := conflictClause{table: p.table, columns: p.conflictColumns}
+
+	conflict := make(map[string]bool)
+	for _, column := range p.conflictColumns {
+		conflict[column] = true
+	}
+
+	for _, column := range updateColumns {
+		if !conflict[column] {
+			clause.excluded = append(clause.excluded, column)
+		}
+	}
+
+	if len(clause.excluded) == 0 {
+		clause.excluded = p.conflictColumns[:1]
+	} else if p.versionColumn != "" {
+		p.upsertVersion(&clause)
+	}
+
+	if p.tenantColumn != "" {
+		clause.where = []string{p.tenantColumn}
+	}
+
+	return clause
+}
+
+// onConflictSQL renders an ON CONFLICT clause
+func onConflictSQL(clause conflictClause) string {
+	table := quoteTable(clause.table)
+
+	target := make([]string, len(clause.columns))
+	for i, column := range clause.columns {
+		target[i] = quoteIdentifier(column)
+	}
+
+	var set []string
+	for _, column := range clause.excluded {
+		set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", quoteIdentifier(column), quoteIdentifier(column)))
+	}
+
+	for _, column := range clause.increment {
+		set = append(set, fmt.Sprintf("%s = %s.%s + 1", quoteIdentifier(column), table, quoteIdentifier(column)))
+	}
+
+	sql := fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(target, ", "), strings.Join(set, ", "))
+
+	var where []string
+	for _, column := range clause.where {
+		where = append(where, fmt.Sprintf("%s.%s = EXCLUDED.%s", table, quoteIdentifier(column), quoteIdentifier(column)))
+	}
+
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	return sql
+}
+
+// quoteIdentifier quotes a column or table name to be used in raw SQL
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// quoteTable quotes a table name that can be qualified with its schema, e.g. public.resources
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i := range parts {
+		parts[i] = quoteIdentifier(parts[i])
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// Get reads the row where whereColumn matches whereValue into structPtr, selecting only the
+// columns of the fields in the read mask, the other fields are left with their zero value, an
+// empty read mask selects every column
+// It returns errors.NotExist if there is no row, and errors.Invalid if a path of the read mask
+// is not a field. Like in AIP-164, a soft deleted row is returned too
+// If read replicas are enabled, the row is read from a healthy replica, see ReadFromPrimary
+func (p *PartialMutation) Get(ctx context.Context, structPtr interface{}, whereColumn, whereValue string, readMask []string) (err error) {
+	ctx, end := instrument(ctx, p.table, "get")
+	defer end(&err)
+
+	if structPtr == nil || reflect.TypeOf(structPtr).Kind() != reflect.Ptr {
+		return fmt.Errorf("expecting a pointer but got %T", structPtr)
+	}
+
+	tenant, err := p.tenantCond(ctx, "get")
+	if err != nil {
+		return err
+	}
+
+	columns, err := p.readColumns(readMask)
+	if err != nil {
+		return err
+	}
+
+	if len(columns) == 0 {
+		columns = []interface{}{"*"}
+	}
+
+	sess, _ := p.readSession(ctx)
+	err = sess.Select(columns...).
+		From(p.table).
+		Where(whereColumn, whereValue).
+		And(tenant).
+		Limit(1).
+		IteratorContext(ctx).
+		One(structPtr)
+	if err == db.ErrNoMoreRows {
+		return errors.E(errors.Errorf("operation get can not be performed, not exist, resource %s", whereValue), errors.NotExist)
+	}
+
+	if err != nil {
+		return translateError(err, "get", whereValue)
+	}
+
+	return nil
 }
 
 // List the elements starting from the given page token, in cae it is empty
-// the list will start from zero, using the column name over with it will be ordered
-func (p *PartialMutation) List(container interface{}, column, pageToken string, where map[string]string, limit int) (nextPageToken string, err error) {
+// the list will start from zero, ordered by the given order_by string (e.g. "display_name desc, quantity"),
+// the primary key is used as tie-breaker for rows with the same values
+// The page token is opaque, and it can only be used with the same order, where values and filter
+// If soft delete is enabled, the deleted rows are hidden unless ShowDeleted is provided
+// If read replicas are enabled, the rows are read from a healthy replica, see ReadReplicas
+// The total size of the results is only computed when it is requested with TotalSize
+func (p *PartialMutation) List(container interface{}, orderBy, pageToken string, where map[string]string, limit int, opts ...ListOption) (result ListResult, err error) {
+	ctx, end := instrument(sessionContext(p.sess), p.table, "list")
+	defer end(&err)
+
+	sess, col := p.sess, p.col
+	if replica, ok := p.readSession(ctx); ok {
+		sess, col = replica, Ensure(replica, p.table)
+	}
+
+	return p.list(ctx, sess, col, container, orderBy, pageToken, where, limit, opts)
+}
+
+// ListContext is like List, but the queries are bound to the given context
+func (p *PartialMutation) ListContext(ctx context.Context, container interface{}, orderBy, pageToken string, where map[string]string, limit int, opts ...ListOption) (result ListResult, err error) {
+	ctx, end := instrument(ctx, p.table, "list")
+	defer end(&err)
+
+	sess, _ := p.readSession(ctx)
+	return p.list(ctx, sess, EnsureContext(ctx, sess, p.table), container, orderBy, pageToken, where, limit, opts)
+}
+
+func (p *PartialMutation) list(ctx context.Context, sess sqlbuilder.Database, col DbCollection, container interface{}, orderBy, pageToken string, where map[string]string, limit int, opts []ListOption) (ListResult, error) {
+	if container == nil || reflect.TypeOf(container).Kind() != reflect.Ptr || reflect.TypeOf(container).Elem().Kind() != reflect.Slice {
+		return ListResult{}, fmt.Errorf("expecting a pointer to a slice but got %T", container)
+	}
+
 	if limit == 0 || limit < 0 {
 		limit = 30
 	}
 
-	var query db.Result
-	if pageToken == "" {
-		query = p.col().Find()
-	} else {
-		query = p.col().Find(fmt.Sprintf("%s >= ?", column), pageToken)
+	var options listOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if err := options.totalSize.validate(); err != nil {
+		return ListResult{}, err
+	}
+
+	columns, err := p.sortColumns(orderBy)
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	filter, err := p.ParseFilter(options.filter)
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	tenant, err := p.tenantCond(ctx, "list")
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	// conds are the conditions of the request, shared by the page and its total size
+	var conds [][]interface{}
+	if len(tenant) > 0 {
+		conds = append(conds, []interface{}{tenant})
 	}
 
 	for k, v := range where {
-		query = query.And(k, v)
+		conds = append(conds, []interface{}{k, v})
+	}
+
+	if filter != nil {
+		conds = append(conds, []interface{}{filter})
+	}
+
+	if p.softDeleteColumn != "" && !options.showDeleted {
+		conds = append(conds, []interface{}{db.Cond{p.softDeleteColumn: db.IsNull()}})
 	}
 
-	err = query.OrderBy(column).Limit(limit).All(container)
+	checksum := requestChecksum(columns, where, options.filter, options.showDeleted)
+	// upper panics when a failed result is chained, e.g. when the context is canceled
+	query := col().Find()
+	if err := query.Err(); err != nil {
+		return ListResult{}, err
+	}
+
+	if pageToken != "" {
+		token, err := decodePageToken(pageToken, p.pageTokenSecret)
+		if err != nil {
+			return ListResult{}, err
+		}
+
+		if token.Checksum != checksum || len(token.Values) != len(columns) {
+			return ListResult{}, errors.E(errors.New("page token does not match the filter or order of the request"), errors.Invalid)
+		}
+
+		query = query.And(keysetCondition(columns, token.Values))
+	}
+
+	for _, cond := range conds {
+		query = query.And(cond...)
+	}
+
+	// an extra row is requested to know if there is a next page
+	err = query.OrderBy(orderByColumns(columns)...).Limit(limit + 1).All(container)
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	var result ListResult
+	if options.totalSize != NoTotalSize {
+		total, err := p.totalSize(ctx, sess, col, conds, options.totalSize)
+		if err != nil {
+			return ListResult{}, err
+		}
+
+		result.TotalSize = &total
+	}
+
+	items := reflect.ValueOf(container).Elem()
+	if items.Len() > limit {
+		items.Set(items.Slice(0, limit))
+
+		values, err := p.rowValues(items.Index(limit-1).Interface(), columns)
+		if err != nil {
+			return ListResult{}, err
+		}
+
+		result.NextPageToken, err = encodePageToken(cursor{Values: values, Checksum: checksum}, p.pageTokenSecret)
+		if err != nil {
+			return ListResult{}, err
+		}
+	}
+
+	result.Items = items.Interface()
+	return result, nil
+}
+
+// rowValues returns the values of the given columns from a row returned by List
+func (p *PartialMutation) rowValues(row interface{}, columns []sortColumn) ([]interface{}, error) {
+	mapValues, err := p.fieldValues(row)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var row struct {
-		ID string `db:"id"`
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		val, ok := mapValues[p.columnsMap[c.column]]
+		if !ok {
+			return nil, errors.E(errors.Errorf("rowValues operation, column %s is not a field of %T", c.column, row), errors.Internal)
+		}
+
+		values[i] = val
 	}
 
-	query.Offset(limit).Limit(1).One(&row) // nolint: errcheck
-	return row.ID, nil
+	return values, nil
 }
 
 // Update the provided values with the included or exluded fields, include rules has preference over
 // the excluded rules
-// If sess is in transaction mode, the new values won't  be readed from the database
-func (p *PartialMutation) Update(sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, fieldMask []string, extraFields map[string]interface{}) error {
+// The field mask accepts dotted paths to change only some keys of a JSONB column, e.g. Settings.Theme
+// If Version is enabled, the row is only changed when the version of structPtr is the stored one,
+// otherwise the error is caused by ErrStaleVersion
+// structPtr is filled with the updated row
+// The constraint violations are returned with the same kinds as Insert
+// It is validated like Insert, but only the errors of the fields changed by the update are kept
+func (p *PartialMutation) Update(sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, fieldMask []string, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(sessionContext(sess), p.table, "update")
+	defer end(&err)
+
+	if err := p.validateUpdate(structPtr, fieldMask); err != nil {
+		return err
+	}
+
+	return p.inOutboxTx(ctx, sess, func(sess sqlbuilder.SQLBuilder) error {
+		return p.update(ctx, sess, structPtr, whereColumn, whereValue, fieldMask, extraFields)
+	})
+}
+
+// UpdateContext is like Update, but the write is bound to the given context
+func (p *PartialMutation) UpdateContext(ctx context.Context, sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, fieldMask []string, extraFields map[string]interface{}) (err error) {
+	ctx, end := instrument(ctx, p.table, "update")
+	defer end(&err)
+
+	if err := p.validateUpdate(structPtr, fieldMask); err != nil {
+		return err
+	}
+
+	return p.inOutboxTx(ctx, bindContext(ctx, sess), func(sess sqlbuilder.SQLBuilder) error {
+		return p.update(ctx, sess, structPtr, whereColumn, whereValue, fieldMask, extraFields)
+	})
+}
+
+func (p *PartialMutation) update(ctx context.Context, sess sqlbuilder.SQLBuilder, structPtr interface{}, whereColumn, whereValue string, fieldMask []string, extraFields map[string]interface{}) error {
 	if structPtr == nil || reflect.TypeOf(structPtr).Kind() != reflect.Ptr {
 		return fmt.Errorf("expecting a pointer but got %T", structPtr)
 	}
 
-	var (
-		columns []string
-		values  []interface{}
-		err     error
-	)
+	tenant, err := p.tenantCond(ctx, "update")
+	if err != nil {
+		return err
+	}
+
+	columns, values, err := p.updateColumnsValues(structPtr, fieldMask, extraFields)
+	if err != nil {
+		return err
+	}
+
+	mapValues := make(map[string]interface{})
+	for i := range columns {
+		mapValues[columns[i]] = values[i]
+	}
+
+	var expectedVersion interface{}
+	if p.versionColumn != "" {
+		if expectedVersion, err = p.expectedVersion(structPtr); err != nil {
+			return err
+		}
+
+		if mapValues[p.versionColumn], err = p.nextVersion(); err != nil {
+			return err
+		}
+	}
 
+	query := sess.Update(p.table).Set(mapValues).Where(whereColumn, whereValue).And(tenant)
+	if p.softDeleteColumn != "" {
+		query = query.And(db.Cond{p.softDeleteColumn: db.IsNull()})
+	}
+
+	if expectedVersion != nil {
+		query = query.And(db.Cond{p.versionColumn: expectedVersion})
+	}
+
+	// the updater can not return rows, so its statement is amended with RETURNING
+	query = query.Amend(func(q string) string {
+		return q + " RETURNING *"
+	})
+
+	err = p.updateReturning(ctx, sess, query, structPtr)
+	if err == db.ErrNoMoreRows {
+		if expectedVersion != nil {
+			return p.staleOrNotExist(ctx, sess, tenant, whereColumn, whereValue)
+		}
+
+		return errors.E(errors.Errorf("operation update can not be performed, not exist, resource %s", whereValue), errors.NotExist)
+	}
+
+	if err != nil {
+		return translateError(err, "update", whereValue)
+	}
+
+	if p.outboxTable == "" {
+		return nil
+	}
+
+	changedColumns := make([]string, 0, len(mapValues))
+	for column := range mapValues {
+		changedColumns = append(changedColumns, column)
+	}
+
+	event, err := p.newEvent(EventUpdate, structPtr, changedColumns, whereValue)
+	if err != nil {
+		return err
+	}
+
+	return p.writeEvents(ctx, sess, event)
+}
+
+// compiler is implemented by the updaters of upper, Compile returns the statement with its
+// placeholders as they are sent to the database
+type compiler interface {
+	Compile() (string, error)
+}
+
+// updateReturning runs an updater amended with RETURNING and scans the first returned row into
+// structPtr, db.ErrNoMoreRows is returned when no row is updated
+func (p *PartialMutation) updateReturning(ctx context.Context, sess sqlbuilder.SQLBuilder, query sqlbuilder.Updater, structPtr interface{}) error {
+	c, ok := query.(compiler)
+	if !ok {
+		return errors.E(errors.Errorf("updater %T can not return rows", query), errors.Internal)
+	}
+
+	statement, err := c.Compile()
+	if err != nil {
+		return err
+	}
+
+	// the statement runs through the session, so the arguments and the returned columns are
+	// converted by the adapter, e.g. arrays and JSONB
+	return sess.IteratorContext(ctx, statement, query.Arguments()...).One(structPtr)
+}
+
+// Delete removes the row where whereColumn matches whereValue, if soft delete is enabled the row is
+// kept and its delete column is stamped with the current time instead
+func (p *PartialMutation) Delete(sess sqlbuilder.SQLBuilder, whereColumn, whereValue string) (err error) {
+	ctx, end := instrument(sessionContext(sess), p.table, "delete")
+	defer end(&err)
+
+	return p.delete(ctx, sess, whereColumn, whereValue)
+}
+
+// DeleteContext is like Delete, but the write is bound to the given context
+func (p *PartialMutation) DeleteContext(ctx context.Context, sess sqlbuilder.SQLBuilder, whereColumn, whereValue string) (err error) {
+	ctx, end := instrument(ctx, p.table, "delete")
+	defer end(&err)
+
+	return p.delete(ctx, bindContext(ctx, sess), whereColumn, whereValue)
+}
+
+func (p *PartialMutation) delete(ctx context.Context, sess sqlbuilder.SQLBuilder, whereColumn, whereValue string) error {
+	tenant, err := p.tenantCond(ctx, "delete")
+	if err != nil {
+		return err
+	}
+
+	var res sql.Result
+	if p.softDeleteColumn != "" {
+		res, err = sess.Update(p.table).
+			Set(p.softDeleteColumn, p.clock()).
+			Where(whereColumn, whereValue).
+			And(tenant).
+			And(db.Cond{p.softDeleteColumn: db.IsNull()}).
+			ExecContext(ctx)
+	} else {
+		res, err = sess.DeleteFrom(p.table).Where(whereColumn, whereValue).And(tenant).ExecContext(ctx)
+	}
+
+	if err != nil {
+		return translateError(err, "delete", whereValue)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.E(errors.Errorf("operation delete can not be performed, not exist, resource %s", whereValue), errors.NotExist)
+	}
+
+	return nil
+}
+
+// Undelete restores a soft deleted row, it returns errors.NotExist if there is no deleted row
+// where whereColumn matches whereValue
+func (p *PartialMutation) Undelete(sess sqlbuilder.SQLBuilder, whereColumn, whereValue string) (err error) {
+	ctx, end := instrument(sessionContext(sess), p.table, "undelete")
+	defer end(&err)
+
+	return p.undelete(ctx, sess, whereColumn, whereValue)
+}
+
+// UndeleteContext is like Undelete, but the write is bound to the given context
+func (p *PartialMutation) UndeleteContext(ctx context.Context, sess sqlbuilder.SQLBuilder, whereColumn, whereValue string) (err error) {
+	ctx, end := instrument(ctx, p.table, "undelete")
+	defer end(&err)
+
+	return p.undelete(ctx, bindContext(ctx, sess), whereColumn, whereValue)
+}
+
+func (p *PartialMutation) undelete(ctx context.Context, sess sqlbuilder.SQLBuilder, whereColumn, whereValue string) error {
+	if p.softDeleteColumn == "" {
+		return errors.E(errors.New("operation undelete can not be performed, soft delete is not enabled"), errors.Invalid)
+	}
+
+	tenant, err := p.tenantCond(ctx, "undelete")
+	if err != nil {
+		return err
+	}
+
+	res, err := sess.Update(p.table).
+		Set(map[string]interface{}{p.softDeleteColumn: nil}).
+		Where(whereColumn, whereValue).
+		And(tenant).
+		And(db.Cond{p.softDeleteColumn: db.IsNotNull()}).
+		ExecContext(ctx)
+	if err != nil {
+		return translateError(err, "undelete", whereValue)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.E(errors.Errorf("operation undelete can not be performed, not exist, resource %s", whereValue), errors.NotExist)
+	}
+
+	return nil
+}
+
+// insertColumnsValues resolves the columns and values of an insert, include rules has preference
+// over the excluded rules
+func (p *PartialMutation) insertColumnsValues(structPtr interface{}, extraFields map[string]interface{}) (columns []string, values []interface{}, err error) {
+	if len(p.includeFields) > 0 {
+		columns, values, err = p.getColumnsValuesIncluding(structPtr, p.includeFields)
+	} else {
+		columns, values, err = p.getColumnsValuesExcluding(structPtr, p.excludeFields)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if extraFields != nil {
+		for k, v := range extraFields {
+			columns = append(columns, k)
+			values = append(values, v)
+		}
+	}
+
+	columns, values, err = p.withVersion(columns, values)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns, values = p.withTimestamps(columns, values, true)
+
+	lenColumns := len(columns)
+	lenValues := len(values)
+	if lenColumns == 0 || lenValues == 0 {
+		return nil, nil, errors.New("query with zero columns and values")
+	}
+
+	if lenColumns != lenValues {
+		return nil, nil, errors.New("columns and values length missmatch")
+	}
+
+	return columns, values, nil
+}
+
+// updateColumnsValues resolves the columns and values of an update, using the update rules when
+// they are defined, and restricting them to the field mask when it is not empty, the dotted paths
+// of the field mask (e.g. Settings.Theme) only change the given keys of a JSONB column
+func (p *PartialMutation) updateColumnsValues(structPtr interface{}, fieldMask []string, extraFields map[string]interface{}) (columns []string, values []interface{}, err error) {
 	includeFields := p.includeFields
 	if p.includeUpdateFields != nil {
 		includeFields = p.includeUpdateFields
@@ -243,6 +1142,12 @@ func (p *PartialMutation) Update(sess sqlbuilder.SQLBuilder, structPtr interface
 	}
 
 	fieldMaskLen := len(fieldMask)
+	maskFields, maskPaths, err := p.parseFieldMask(fieldMask)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paths := allowedJSONBPaths(maskPaths, includeFields, excludeFields)
 
 	if len(includeFields) > 0 {
 		if fieldMaskLen > 0 {
@@ -252,7 +1157,7 @@ func (p *PartialMutation) Update(sess sqlbuilder.SQLBuilder, structPtr interface
 			}
 
 			var newIncludeFields []string
-			for _, v := range fieldMask {
+			for _, v := range maskFields {
 				if _, ok := mapIncludeFields[v]; ok {
 					newIncludeFields = append(newIncludeFields, v)
 				}
@@ -271,7 +1176,7 @@ func (p *PartialMutation) Update(sess sqlbuilder.SQLBuilder, structPtr interface
 			}
 
 			var includeFields []string
-			for _, v := range fieldMask {
+			for _, v := range maskFields {
 				if _, ok := mapExludeFields[v]; !ok {
 					includeFields = append(includeFields, v)
 				}
@@ -281,48 +1186,53 @@ func (p *PartialMutation) Update(sess sqlbuilder.SQLBuilder, structPtr interface
 	}
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	for k, v := range extraFields {
-		columns = append(columns, k)
-		values = append(values, v)
-	}
+	if len(paths) > 0 {
+		jsonbColumns, jsonbValues, err := p.jsonbColumnsValues(structPtr, paths, columns)
+		if err != nil {
+			return nil, nil, err
+		}
 
-	lenColumns := len(columns)
-	lenValues := len(values)
-	if lenColumns == 0 || lenValues == 0 {
-		return errors.New("query with zero columns and values")
+		columns = append(columns, jsonbColumns...)
+		values = append(values, jsonbValues...)
 	}
 
-	if lenColumns != lenValues {
-		return errors.New("columns and values length missmatch")
+	for k, v := range extraFields {
+		columns = append(columns, k)
+		values = append(values, v)
 	}
 
-	mapValues := make(map[string]interface{})
-	for i := range columns {
-		mapValues[columns[i]] = values[i]
+	if p.versionColumn != "" {
+		columns, values = withoutColumn(columns, values, p.versionColumn)
 	}
 
-	query := sess.Update(p.table).Set(mapValues).Where(whereColumn, whereValue)
-	res, err := query.Exec()
-	if err != nil {
-		return err
+	// the rows can not be moved to another tenant
+	if p.tenantColumn != "" {
+		columns, values = withoutColumn(columns, values, p.tenantColumn)
 	}
 
-	if n, _ := res.RowsAffected(); n == 0 {
-		return errors.E(errors.Errorf("operation update can not be performed, not exist, resource %s", whereValue), errors.NotExist)
+	lenColumns := len(columns)
+	lenValues := len(values)
+	if lenColumns == 0 || lenValues == 0 {
+		return nil, nil, errors.New("query with zero columns and values")
 	}
 
-	if _, ok := sess.(sqlbuilder.Tx); ok {
-		return nil
+	if lenColumns != lenValues {
+		return nil, nil, errors.New("columns and values length missmatch")
 	}
 
-	return p.col().Find(whereColumn, whereValue).Limit(1).One(structPtr)
+	// the update time is only changed when there is something else to update
+	columns, values = p.withTimestamps(columns, values, false)
+	return columns, values, nil
 }
 
 func (p *PartialMutation) getColumnsValuesIncluding(structValue interface{}, fields []string) (columns []string, values []interface{}, err error) {
-	mapValues := structs.Map(structValue)
+	mapValues, err := p.fieldValues(structValue)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	for _, field := range fields {
 		val, ok := mapValues[field]
@@ -330,6 +1240,10 @@ func (p *PartialMutation) getColumnsValuesIncluding(structValue interface{}, fie
 			return nil, nil, errors.E(errors.Errorf("getColumnsValuesIncluding operation, invalid field: %s", field), errors.Internal)
 		}
 
+		if p.fields[field].autoCreate || p.fields[field].autoUpdate {
+			continue
+		}
+
 		columns = append(columns, p.fieldsMap[field])
 		values = append(values, val)
 	}
@@ -338,7 +1252,10 @@ func (p *PartialMutation) getColumnsValuesIncluding(structValue interface{}, fie
 }
 
 func (p *PartialMutation) getColumnsValuesExcluding(structValue interface{}, fields []string) (columns []string, values []interface{}, err error) {
-	mapValues := structs.Map(structValue)
+	mapValues, err := p.fieldValues(structValue)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	for _, column := range fields {
 		delete(mapValues, column)
@@ -346,7 +1263,7 @@ func (p *PartialMutation) getColumnsValuesExcluding(structValue interface{}, fie
 
 	for field, val := range mapValues {
 		col, ok := p.fieldsMap[field]
-		if !ok {
+		if !ok || p.fields[field].autoCreate || p.fields[field].autoUpdate {
 			continue
 		}
 
@@ -356,3 +1273,19 @@ func (p *PartialMutation) getColumnsValuesExcluding(structValue interface{}, fie
 
 	return columns, values, nil
 }
+
+// resolveField resolves a field of the struct provided with Values by its db column or by its
+// struct field name
+func (p *PartialMutation) resolveField(name string) (column string, fieldType reflect.Type, ok bool) {
+	fieldName, ok := p.columnsMap[name]
+	if !ok {
+		if column, ok = p.fieldsMap[name]; !ok {
+			return "", nil, false
+		}
+
+		fieldName = name
+	}
+
+	field := p.fields[fieldName]
+	return field.column, field.typ, true
+}
@@ -3,10 +3,13 @@ package upperdb
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/upperdb/upperdbtest"
 	db "upper.io/db.v3"
 	"upper.io/db.v3/lib/sqlbuilder"
 )
@@ -15,8 +18,8 @@ type Resource struct {
 	Name        string    `db:"name"`
 	DisplayName string    `db:"display_name"`
 	Quantity    int       `db:"quantity"`
-	CreateTime  time.Time `db:"-"`
-	UpdateTime  time.Time `db:"-"`
+	CreateTime  time.Time `db:"create_time,autocreate"`
+	UpdateTime  time.Time `db:"update_time,autoupdate"`
 }
 
 func TestColumnValuesIncluded(t *testing.T) {
@@ -128,6 +131,263 @@ func TestColumnValuesExcluded(t *testing.T) {
 	}
 }
 
+func TestOnConflictClause(t *testing.T) {
+	var tests = []struct {
+		name            string
+		conflictColumns []string
+		updateColumns   []string
+		versionColumn   string
+		tenantColumn    string
+		expected        string
+	}{
+		{
+			name:            "Update columns",
+			conflictColumns: []string{"name"},
+			updateColumns:   []string{"display_name", "quantity"},
+			expected:        `ON CONFLICT ("name") DO UPDATE SET "display_name" = EXCLUDED."display_name", "quantity" = EXCLUDED."quantity"`,
+		},
+		{
+			name:            "Conflict columns are not updated",
+			conflictColumns: []string{"name", "parent"},
+			updateColumns:   []string{"name", "quantity"},
+			expected:        `ON CONFLICT ("name", "parent") DO UPDATE SET "quantity" = EXCLUDED."quantity"`,
+		},
+		{
+			name:            "Nothing to update",
+			conflictColumns: []string{"name"},
+			updateColumns:   []string{"name"},
+			versionColumn:   "version",
+			expected:        `ON CONFLICT ("name") DO UPDATE SET "name" = EXCLUDED."name"`,
+		},
+		{
+			name:            "Version and tenant",
+			conflictColumns: []string{"name"},
+			updateColumns:   []string{"quantity"},
+			versionColumn:   "version",
+			tenantColumn:    "tenant_id",
+			expected: `ON CONFLICT ("name") DO UPDATE SET "quantity" = EXCLUDED."quantity", "version" = "resources"."version" + 1 ` +
+				`WHERE "resources"."tenant_id" = EXCLUDED."tenant_id"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mut, err := NewPartialMutation(
+				Values(struct {
+					Name     string `db:"name"`
+					Quantity int    `db:"quantity"`
+					Version  int64  `db:"version"`
+				}{}),
+				Include([]string{"Name", "Quantity"}),
+				Table("resources"),
+				Session(&databaseMock{}),
+				ConflictColumns(tt.conflictColumns),
+				Version(tt.versionColumn),
+				Tenant(tt.tenantColumn),
+			)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := onConflictSQL(mut.onConflictClause(tt.updateColumns))
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+type storedResource struct {
+	ID          int64     `db:"id"`
+	Name        string    `db:"name"`
+	DisplayName string    `db:"display_name"`
+	Quantity    int       `db:"quantity"`
+	Version     int64     `db:"version"`
+	UpdateTime  time.Time `db:"update_time,autoupdate"`
+}
+
+func TestPartialMutationInMemory(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+		Version("version"),
+		Clock(func() time.Time { return now }),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"CAN", "MEX", "USA"} {
+		r := storedResource{Name: name, DisplayName: name, Quantity: i}
+		if err := mut.Insert(sess, &r, "name", name, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if r.ID != int64(i+1) || r.Version != 1 || !r.UpdateTime.Equal(now) {
+			t.Errorf("%s: expecting the inserted row, got %v", name, r)
+		}
+	}
+
+	r := storedResource{DisplayName: "Canada", Version: 1}
+	if err := mut.Update(sess, &r, "id", "1", []string{"DisplayName"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := storedResource{ID: 1, Name: "CAN", DisplayName: "Canada", Version: 2, UpdateTime: now}
+	if equal := cmp.Equal(expected, r); !equal {
+		diff := cmp.Diff(expected, r)
+		t.Errorf("+got, -want, %s", diff)
+	}
+
+	stale := storedResource{DisplayName: "Canada", Version: 1}
+	if err := mut.Update(sess, &stale, "id", "1", []string{"DisplayName"}, nil); errors.Cause(err) != ErrStaleVersion || !errors.IsKind(err, errors.Duplicated) {
+		t.Errorf("expecting a stale version error, got %v", err)
+	}
+
+	unversioned := storedResource{DisplayName: "Canadá"}
+	if err := mut.Update(sess, &unversioned, "id", "1", []string{"DisplayName"}, nil); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting the version to be required, got %v", err)
+	}
+
+	if err := mut.Update(sess, &stale, "id", "9", []string{"DisplayName"}, nil); !errors.IsKind(err, errors.NotExist) {
+		t.Errorf("expecting a not exist error, got %v", err)
+	}
+
+	var (
+		got       []string
+		pageToken string
+	)
+
+	for {
+		var page []storedResource
+		result, err := mut.List(&page, "quantity desc", pageToken, nil, 1, Filter("quantity < 2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pageToken = result.NextPageToken
+
+		for _, item := range page {
+			got = append(got, item.Name)
+		}
+
+		if pageToken == "" {
+			break
+		}
+	}
+
+	if equal := cmp.Equal([]string{"MEX", "CAN"}, got); !equal {
+		diff := cmp.Diff([]string{"MEX", "CAN"}, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+
+	var page []storedResource
+	result, err := mut.List(&page, "", "", nil, 1, Filter("quantity < 2"), TotalSize(ExactTotalSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.TotalSize == nil || *result.TotalSize != 2 || result.NextPageToken == "" || len(result.Items.([]storedResource)) != 1 {
+		t.Errorf("expecting the first page and the total size of the results, got %+v", result)
+	}
+
+	if _, err := mut.List(&page, "", "", nil, 1, TotalSize(TotalSizeMode(9))); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error with an unknown total size mode, got %v", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+		Clock(func() time.Time { return now }),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mut.Insert(sess, &storedResource{Name: "CAN", DisplayName: "Canada", Quantity: 3}, "name", "CAN", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name        string
+		whereValue  string
+		readMask    []string
+		expected    storedResource
+		expectedErr errors.Kind
+	}{
+		{
+			name:       "Empty read mask",
+			whereValue: "1",
+			expected:   storedResource{ID: 1, Name: "CAN", DisplayName: "Canada", Quantity: 3, UpdateTime: now},
+		},
+		{
+			name:       "Wildcard",
+			whereValue: "1",
+			readMask:   []string{"*"},
+			expected:   storedResource{ID: 1, Name: "CAN", DisplayName: "Canada", Quantity: 3, UpdateTime: now},
+		},
+		{
+			name:       "Read mask",
+			whereValue: "1",
+			readMask:   []string{"DisplayName", "Quantity", "DisplayName"},
+			expected:   storedResource{DisplayName: "Canada", Quantity: 3},
+		},
+		{
+			name:        "Unknown path",
+			whereValue:  "1",
+			readMask:    []string{"Color"},
+			expectedErr: errors.Invalid,
+		},
+		{
+			name:        "Missing row",
+			whereValue:  "2",
+			readMask:    []string{"Name"},
+			expectedErr: errors.NotExist,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := storedResource{Name: "stale"}
+			err := mut.Get(context.Background(), &got, "id", tt.whereValue, tt.readMask)
+			if tt.expectedErr != 0 {
+				if !errors.IsKind(err, tt.expectedErr) {
+					t.Errorf("%s: expecting an error of kind %v, got %v", tt.name, tt.expectedErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
 type databaseMock struct{}
 
 func (d *databaseMock) Driver() interface{} {
@@ -297,3 +557,537 @@ func (d *databaseMock) SetTxOptions(sql.TxOptions) {
 func (d *databaseMock) TxOptions() *sql.TxOptions {
 	panic("not implemented")
 }
+
+func TestCanceledContext(t *testing.T) {
+	rec, sess := newRecorder(t)
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var items []storedResource
+	for name, err := range map[string]error{
+		"insert": mut.InsertContext(ctx, sess, &storedResource{Name: "CAN"}, "name", "CAN", nil),
+		"update": mut.UpdateContext(ctx, sess, &storedResource{Name: "CAN"}, "id", "1", []string{"Name"}, nil),
+		"list": func() error {
+			_, err := mut.ListContext(ctx, &items, "", "", nil, 10)
+			return err
+		}(),
+	} {
+		if errors.Cause(err) != context.Canceled {
+			t.Errorf("%s: expecting the canceled context error, got %v", name, err)
+		}
+	}
+
+	for _, statement := range []string{"INSERT", "UPDATE", `SELECT * FROM "resources"`} {
+		if got := rec.matching(statement); len(got) > 0 {
+			t.Errorf("expecting the canceled statements to not be sent, got %v", got)
+		}
+	}
+}
+
+type taggedResource struct {
+	ID   int64    `db:"id"`
+	Name string   `db:"name"`
+	Tags []string `db:"tags"`
+}
+
+func TestUpdateStatement(t *testing.T) {
+	rec, sess := newRecorder(t, reply{
+		contains: `UPDATE "resources"`,
+		columns:  []string{"id", "name", "tags"},
+		rows:     [][]driver.Value{{int64(1), "Canada", "{a,b}"}},
+	})
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(taggedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := taggedResource{Name: "Canada", Tags: []string{"a", "b"}}
+	if err := mut.Update(sess, &r, "id", "1", []string{"Name", "Tags"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.ID != 1 {
+		t.Errorf("expecting the returned row to be scanned, got %v", r)
+	}
+
+	expected := []string{`UPDATE "resources" SET "name" = $1, "tags" = $2 WHERE ("id" = $3) RETURNING *`}
+	if got := rec.matching("UPDATE"); !cmp.Equal(expected, got) {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+}
+
+func TestUpsertStatement(t *testing.T) {
+	rec, sess := newRecorder(t, reply{
+		contains: `INSERT INTO "resources"`,
+		columns:  []string{"id", "name", "tags"},
+		rows:     [][]driver.Value{{int64(1), "Canada", "{a,b}"}},
+	})
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(taggedResource{}),
+		Include([]string{"Name", "Tags"}),
+		Table("resources"),
+		ConflictColumns([]string{"name"}),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := taggedResource{Name: "Canada", Tags: []string{"a", "b"}}
+	if err := mut.Upsert(sess, &r, "Canada", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.ID != 1 {
+		t.Errorf("expecting the returned row to be scanned, got %v", r)
+	}
+
+	expected := []string{`INSERT INTO "resources" ("name", "tags") VALUES ($1, $2) ` +
+		`ON CONFLICT ("name") DO UPDATE SET "tags" = EXCLUDED."tags" RETURNING *`}
+	if got := rec.matching("INSERT"); !cmp.Equal(expected, got) {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+}
+
+type nicknamedResource struct {
+	ID       int64   `db:"id"`
+	Nickname *string `db:"nickname"`
+}
+
+func TestListNullable(t *testing.T) {
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(nicknamedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := "a", "b"
+	for _, nickname := range []*string{&a, nil, &b, nil} {
+		if err := mut.Insert(sess, &nicknamedResource{Nickname: nickname}, "id", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var items []nicknamedResource
+	if _, err := mut.List(&items, "nickname", "", nil, 1); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting the nullable order_by to be rejected, got %v", err)
+	}
+
+	var (
+		got       []int64
+		pageToken string
+	)
+
+	for {
+		var page []nicknamedResource
+		result, err := mut.List(&page, "id desc", pageToken, nil, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, item := range page {
+			got = append(got, item.ID)
+		}
+
+		if pageToken = result.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+
+	expected := []int64{4, 3, 2, 1}
+	if equal := cmp.Equal(expected, got); !equal {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("expecting every page across the NULL values, +got, -want, %s", diff)
+	}
+}
+
+func TestEstimatedTotalSize(t *testing.T) {
+	var tests = []struct {
+		name      string
+		filter    string
+		reltuples int64
+		expected  int64
+		explained bool
+	}{
+		{
+			name:      "Table statistics",
+			reltuples: 42,
+			expected:  42,
+		},
+		{
+			name:      "Table never analyzed",
+			reltuples: -1,
+			expected:  7,
+			explained: true,
+		},
+		{
+			name:      "Filter",
+			filter:    "quantity < 2",
+			reltuples: 42,
+			expected:  7,
+			explained: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, sess := newRecorder(t,
+				reply{contains: "reltuples", columns: []string{"reltuples"}, rows: [][]driver.Value{{tt.reltuples}}},
+				reply{contains: "EXPLAIN", columns: []string{"QUERY PLAN"}, rows: [][]driver.Value{{`[{"Plan": {"Plan Rows": 7}}]`}}},
+			)
+			defer ClearCache()
+
+			mut, err := NewPartialMutation(
+				Values(storedResource{}),
+				Exclude([]string{"ID"}),
+				Table("public.resources"),
+				Session(sess),
+			)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var items []storedResource
+			result, err := mut.List(&items, "", "", nil, 10, Filter(tt.filter), TotalSize(EstimatedTotalSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.TotalSize == nil || *result.TotalSize != tt.expected {
+				t.Errorf("%s: expecting a total size of %d, got %v", tt.name, tt.expected, result.TotalSize)
+			}
+
+			if tt.filter == "" {
+				expected := [][]driver.Value{{`"public"."resources"`}}
+				if got := rec.arguments("reltuples"); !cmp.Equal(expected, got) {
+					diff := cmp.Diff(expected, got)
+					t.Errorf("%s: +got, -want, %s", tt.name, diff)
+				}
+			}
+
+			if explained := rec.matching(`EXPLAIN (FORMAT JSON) SELECT * FROM "public"."resources"`); (len(explained) > 0) != tt.explained {
+				t.Errorf("%s: expecting the query to be explained: %v, got %v", tt.name, tt.explained, explained)
+			}
+		})
+	}
+}
+
+func TestUnknownTotalSize(t *testing.T) {
+	rec, sess := newRecorder(t)
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []storedResource
+	if _, err := mut.List(&items, "", "", nil, 10, TotalSize(TotalSizeMode(9))); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error, got %v", err)
+	}
+
+	if got := rec.matching(`SELECT * FROM "resources"`); len(got) > 0 {
+		t.Errorf("expecting the unknown mode to be rejected before the query, got %v", got)
+	}
+}
+
+type deletableResource struct {
+	ID         int64      `db:"id"`
+	Name       string     `db:"name"`
+	DeleteTime *time.Time `db:"delete_time"`
+}
+
+func TestDelete(t *testing.T) {
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(deletableResource{}),
+		Exclude([]string{"ID", "DeleteTime"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mut.Insert(sess, &deletableResource{Name: "CAN"}, "name", "CAN", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mut.Delete(sess, "id", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows := sess.Rows("resources"); len(rows) != 0 {
+		t.Errorf("expecting the row to be removed, got %v", rows)
+	}
+
+	if err := mut.Delete(sess, "id", "1"); !errors.IsKind(err, errors.NotExist) {
+		t.Errorf("expecting a not exist error, got %v", err)
+	}
+
+	if err := mut.Undelete(sess, "id", "1"); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error without soft delete, got %v", err)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(deletableResource{}),
+		Exclude([]string{"ID", "DeleteTime"}),
+		Table("resources"),
+		Session(sess),
+		SoftDelete("delete_time"),
+		Clock(func() time.Time { return now }),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"CAN", "MEX"} {
+		if err := mut.Insert(sess, &deletableResource{Name: name}, "name", name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mut.Delete(sess, "id", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mut.Delete(sess, "id", "1"); !errors.IsKind(err, errors.NotExist) {
+		t.Errorf("expecting the deleted row to not exist, got %v", err)
+	}
+
+	var deleted deletableResource
+	if err := mut.Get(context.Background(), &deleted, "id", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted.DeleteTime == nil || !deleted.DeleteTime.Equal(now) {
+		t.Errorf("expecting the delete time to be stamped with the clock, got %v", deleted.DeleteTime)
+	}
+
+	names := func(opts ...ListOption) []string {
+		var items []deletableResource
+		if _, err := mut.List(&items, "", "", nil, 10, opts...); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, item := range items {
+			got = append(got, item.Name)
+		}
+
+		return got
+	}
+
+	var tests = []struct {
+		name     string
+		given    []ListOption
+		expected []string
+	}{
+		{
+			name:     "Deleted rows are hidden",
+			expected: []string{"MEX"},
+		},
+		{
+			name:     "Show deleted",
+			given:    []ListOption{ShowDeleted(true)},
+			expected: []string{"CAN", "MEX"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := names(tt.given...); !cmp.Equal(tt.expected, got) {
+			diff := cmp.Diff(tt.expected, got)
+			t.Errorf("%s: +got, -want, %s", tt.name, diff)
+		}
+	}
+
+	var page []deletableResource
+	result, err := mut.List(&page, "", "", nil, 1, ShowDeleted(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mut.List(&page, "", result.NextPageToken, nil, 1); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting the page token to be rejected without ShowDeleted, got %v", err)
+	}
+
+	if err := mut.Undelete(sess, "id", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mut.Undelete(sess, "id", "1"); !errors.IsKind(err, errors.NotExist) {
+		t.Errorf("expecting a not exist error for a row that is not deleted, got %v", err)
+	}
+
+	if got := names(); !cmp.Equal([]string{"CAN", "MEX"}, got) {
+		t.Errorf("expecting the row to be restored, got %v", got)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		ExcludeUpdate([]string{"ID", "DisplayName"}),
+		Table("resources"),
+		Session(sess),
+		ConflictColumns([]string{"name"}),
+		Clock(func() time.Time { return now }),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := storedResource{Name: "CAN", DisplayName: "Canada", Quantity: 1}
+	if err := mut.Upsert(sess, &created, "CAN", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := storedResource{Name: "CAN", DisplayName: "Kanada", Quantity: 5}
+	if err := mut.Upsert(sess, &updated, "CAN", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := storedResource{ID: 1, Name: "CAN", DisplayName: "Canada", Quantity: 5, UpdateTime: now}
+	if equal := cmp.Equal(expected, updated); !equal {
+		diff := cmp.Diff(expected, updated)
+		t.Errorf("+got, -want, %s", diff)
+	}
+
+	if rows := sess.Rows("resources"); len(rows) != 1 {
+		t.Errorf("expecting the existing row to be updated, got %d rows", len(rows))
+	}
+
+	noConflict, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := noConflict.Upsert(sess, &updated, "CAN", nil); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error without conflict columns, got %v", err)
+	}
+}
+
+func TestInsertMany(t *testing.T) {
+	sess := upperdbtest.New()
+	sess.Unique("resources", "resources_name_key", "name")
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two rows of five columns in each statement
+	mut.chunkParameters = 10
+
+	values := []storedResource{{Name: "CAN"}, {Name: "MEX"}, {Name: "USA"}}
+	if err := mut.InsertMany(sess, &values, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pointers := []*storedResource{{Name: "ARG"}, {Name: "BRA"}}
+	if err := mut.InsertMany(sess, &pointers, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int64
+	for _, r := range values {
+		got = append(got, r.ID)
+	}
+
+	for _, r := range pointers {
+		got = append(got, r.ID)
+	}
+
+	if expected := []int64{1, 2, 3, 4, 5}; !cmp.Equal(expected, got) {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("expecting the generated ids to be filled back, +got, -want, %s", diff)
+	}
+
+	if err := mut.InsertMany(sess, &[]*storedResource{{Name: "CHL"}, nil}, nil); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error with a nil element, got %v", err)
+	}
+
+	// the second chunk fails with the duplicated name, and the first one is rolled back
+	duplicated := []storedResource{{Name: "PER"}, {Name: "URU"}, {Name: "ECU"}, {Name: "CAN"}}
+	if err := mut.InsertMany(sess, &duplicated, nil); !errors.IsKind(err, errors.Duplicated) {
+		t.Errorf("expecting a duplicated error, got %v", err)
+	}
+
+	if rows := sess.Rows("resources"); len(rows) != 5 {
+		t.Errorf("expecting no row of the failed insert, got %d rows", len(rows))
+	}
+
+	if duplicated[0].ID != 0 {
+		t.Errorf("expecting the slice not to be filled back, got id %d", duplicated[0].ID)
+	}
+}
@@ -0,0 +1,206 @@
+package upperdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/postgresql"
+)
+
+// recorder is a database/sql driver that records the statements sent by upper with their
+// whitespace collapsed, the queries are answered with the rows of the first reply whose text is
+// contained in the statement, or no rows
+type recorder struct {
+	mu         sync.Mutex
+	statements []string
+	args       [][]driver.Value
+	replies    []reply
+	// used counts the statements answered by each reply
+	used map[int]int
+}
+
+type reply struct {
+	contains string
+	columns  []string
+	rows     [][]driver.Value
+	// times is the number of statements answered by the reply, unlimited when it is zero, so
+	// the same statement can be answered by the next replies
+	times int
+}
+
+// recorderReplies answer the queries run by upper when a session is opened and a collection
+// is used for the first time
+var recorderReplies = []reply{
+	{contains: "CURRENT_DATABASE()", columns: []string{"name"}, rows: [][]driver.Value{{"test"}}},
+	{contains: `"information_schema"."tables"`, columns: []string{"table_name"}, rows: [][]driver.Value{{"resources"}}},
+	{contains: `"pkey"`, columns: []string{"pkey"}, rows: [][]driver.Value{{"id"}}},
+}
+
+var (
+	recorders    sync.Map
+	recorderSeq  uint64
+	registerOnce sync.Once
+)
+
+// newRecorder returns an upper session of the postgresql adapter on top of a recorder
+func newRecorder(t *testing.T, replies ...reply) (*recorder, sqlbuilder.Database) {
+	registerOnce.Do(func() {
+		sql.Register("upperdb_recorder", recorderDriver{})
+	})
+
+	rec := &recorder{replies: append(replies, recorderReplies...), used: make(map[int]int)}
+	dsn := fmt.Sprint(atomic.AddUint64(&recorderSeq, 1))
+	recorders.Store(dsn, rec)
+
+	conn, err := sql.Open("upperdb_recorder", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := postgresql.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rec, sess
+}
+
+// matching returns the recorded statements that contain the given text
+func (r *recorder) matching(text string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var statements []string
+	for _, statement := range r.statements {
+		if strings.Contains(statement, text) {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
+
+// arguments returns the arguments of the recorded statements that contain the given text
+func (r *recorder) arguments(text string) [][]driver.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var args [][]driver.Value
+	for i, statement := range r.statements {
+		if strings.Contains(statement, text) {
+			args = append(args, r.args[i])
+		}
+	}
+
+	return args
+}
+
+func (r *recorder) record(query string, args []driver.Value) reply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statement := strings.Join(strings.Fields(query), " ")
+	r.statements = append(r.statements, statement)
+	r.args = append(r.args, args)
+	for i, reply := range r.replies {
+		if !strings.Contains(statement, reply.contains) || (reply.times > 0 && r.used[i] >= reply.times) {
+			continue
+		}
+
+		r.used[i]++
+		return reply
+	}
+
+	return reply{}
+}
+
+type recorderDriver struct{}
+
+func (recorderDriver) Open(dsn string) (driver.Conn, error) {
+	rec, ok := recorders.Load(dsn)
+	if !ok {
+		return nil, fmt.Errorf("unknown recorder %s", dsn)
+	}
+
+	return &recorderConn{rec.(*recorder)}, nil
+}
+
+type recorderConn struct {
+	rec *recorder
+}
+
+func (c *recorderConn) Prepare(query string) (driver.Stmt, error) {
+	return &recorderStmt{rec: c.rec, query: query}, nil
+}
+
+func (c *recorderConn) Close() error {
+	return nil
+}
+
+func (c *recorderConn) Begin() (driver.Tx, error) {
+	c.rec.record("BEGIN", nil)
+	return c, nil
+}
+
+func (c *recorderConn) Commit() error {
+	c.rec.record("COMMIT", nil)
+	return nil
+}
+
+func (c *recorderConn) Rollback() error {
+	c.rec.record("ROLLBACK", nil)
+	return nil
+}
+
+type recorderStmt struct {
+	rec   *recorder
+	query string
+}
+
+func (s *recorderStmt) Close() error {
+	return nil
+}
+
+func (s *recorderStmt) NumInput() int {
+	return -1
+}
+
+func (s *recorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.rec.record(s.query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recorderStmt) Query(args []driver.Value) (driver.Rows, error) {
+	reply := s.rec.record(s.query, args)
+	return &recorderRows{reply: reply}, nil
+}
+
+type recorderRows struct {
+	reply reply
+	pos   int
+}
+
+func (r *recorderRows) Columns() []string {
+	return r.reply.columns
+}
+
+func (r *recorderRows) Close() error {
+	return nil
+}
+
+func (r *recorderRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.reply.rows) {
+		return io.EOF
+	}
+
+	copy(dest, r.reply.rows[r.pos])
+	r.pos++
+	return nil
+}
@@ -0,0 +1,236 @@
+package upperdb
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mishudark/errors"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// replicationLagQuery returns the seconds that a replica is behind the primary, it is zero when
+// the replica has replayed everything it received, and on the primary
+const replicationLagQuery = `SELECT COALESCE(CASE
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+END, 0)`
+
+// ReplicaPool routes the reads of PartialMutation to healthy read replicas, in round robin. A
+// replica is checked when it is used and its last check is older than the check interval, the
+// check runs in the background, and until it passes the replica is out of rotation, so the reads
+// go to the primary when no replica is healthy
+type ReplicaPool struct {
+	replicas      []*replica
+	healthCheck   func(ctx context.Context, sess sqlbuilder.Database) error
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+	maxLag        time.Duration
+	now           func() time.Time
+	next          uint32
+}
+
+type replica struct {
+	sess     sqlbuilder.Database
+	mu       sync.Mutex
+	healthy  bool
+	checking bool
+	checked  time.Time
+}
+
+// ReplicaPoolOption defines an option that changes the values of ReplicaPool struct
+type ReplicaPoolOption func(p *ReplicaPool)
+
+// CheckInterval set the time between the health checks of a replica, 5 seconds by default
+func CheckInterval(interval time.Duration) ReplicaPoolOption {
+	return func(p *ReplicaPool) {
+		p.checkInterval = interval
+	}
+}
+
+// CheckTimeout set the maximum time of a health check, a second by default
+func CheckTimeout(timeout time.Duration) ReplicaPoolOption {
+	return func(p *ReplicaPool) {
+		p.checkTimeout = timeout
+	}
+}
+
+// MaxReplicationLag set the lag after which a replica is taken out of rotation, 10 seconds by
+// default, it is only used by the default health check
+func MaxReplicationLag(lag time.Duration) ReplicaPoolOption {
+	return func(p *ReplicaPool) {
+		p.maxLag = lag
+	}
+}
+
+// HealthCheck replaces the default health check, which pings the replica and compares its
+// replication lag with the maximum lag, a replica is healthy when the check returns nil
+func HealthCheck(check func(ctx context.Context, sess sqlbuilder.Database) error) ReplicaPoolOption {
+	return func(p *ReplicaPool) {
+		p.healthCheck = check
+	}
+}
+
+// NewReplicaPool returns a ReplicaPool of the given sessions, the replicas are out of rotation
+// until their first check passes, Check can be used to check them at startup
+func NewReplicaPool(replicas []sqlbuilder.Database, opts ...ReplicaPoolOption) (*ReplicaPool, error) {
+	p := &ReplicaPool{
+		checkInterval: 5 * time.Second,
+		checkTimeout:  time.Second,
+		maxLag:        10 * time.Second,
+		now:           time.Now,
+	}
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	if len(replicas) == 0 {
+		return nil, errors.E(errors.New("ReplicaPool, at least a replica is required"), errors.Invalid)
+	}
+
+	if p.checkInterval <= 0 || p.checkTimeout <= 0 {
+		return nil, errors.E(errors.New("ReplicaPool, check interval and timeout must be positive"), errors.Invalid)
+	}
+
+	if p.healthCheck == nil {
+		p.healthCheck = p.defaultHealthCheck
+	}
+
+	for _, sess := range replicas {
+		if sess == nil {
+			return nil, errors.E(errors.New("ReplicaPool, replica sessions can not be nil"), errors.Invalid)
+		}
+
+		p.replicas = append(p.replicas, &replica{sess: sess})
+	}
+
+	return p, nil
+}
+
+// Check runs the health check of every replica and waits for them, it returns the number of
+// healthy replicas
+func (p *ReplicaPool) Check(ctx context.Context) int {
+	var (
+		wg      sync.WaitGroup
+		healthy int32
+	)
+
+	for _, r := range p.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			if p.check(ctx, r) {
+				atomic.AddInt32(&healthy, 1)
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	return int(healthy)
+}
+
+// Session returns a healthy replica, false means that no replica is healthy and the primary
+// must be used
+func (p *ReplicaPool) Session() (sqlbuilder.Database, bool) {
+	start := int(atomic.AddUint32(&p.next, 1))
+	for i := range p.replicas {
+		r := p.replicas[(start+i)%len(p.replicas)]
+		if p.available(r) {
+			return r.sess, true
+		}
+	}
+
+	return nil, false
+}
+
+// available returns the last known health of the replica, and starts a check in the
+// background when it is stale
+func (p *ReplicaPool) available(r *replica) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.checking && p.now().Sub(r.checked) >= p.checkInterval {
+		r.checking = true
+		go p.check(context.Background(), r)
+	}
+
+	return r.healthy
+}
+
+// check runs the health check of a replica and records its result
+func (p *ReplicaPool) check(ctx context.Context, r *replica) bool {
+	ctx, cancel := context.WithTimeout(ctx, p.checkTimeout)
+	defer cancel()
+
+	err := p.healthCheck(ctx, r.sess)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.healthy = err == nil
+	r.checking = false
+	r.checked = p.now()
+
+	return r.healthy
+}
+
+// defaultHealthCheck pings the replica and reads its replication lag
+func (p *ReplicaPool) defaultHealthCheck(ctx context.Context, sess sqlbuilder.Database) error {
+	if driver, ok := sess.Driver().(*sql.DB); ok {
+		if err := driver.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	row, err := sess.QueryRowContext(ctx, replicationLagQuery)
+	if err != nil {
+		return err
+	}
+
+	var lag float64
+	if err := row.Scan(&lag); err != nil {
+		return err
+	}
+
+	if time.Duration(lag*float64(time.Second)) > p.maxLag {
+		return errors.E(errors.Errorf("replica is %.1f seconds behind the primary", lag), errors.Transient)
+	}
+
+	return nil
+}
+
+type primaryKey struct{}
+
+// ReadFromPrimary returns a copy of ctx whose reads skip the replicas, e.g. to read a row
+// right after writing it
+func ReadFromPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// ReadReplicas routes the reads of List to the replicas of the pool, the writes and the rows
+// that they return always use the primary session
+func ReadReplicas(pool *ReplicaPool) Option {
+	return func(op *PartialMutation) {
+		op.replicas = pool
+	}
+}
+
+// readSession returns the session used by the reads of ctx, a healthy replica or the primary
+func (p *PartialMutation) readSession(ctx context.Context) (sqlbuilder.Database, bool) {
+	if p.replicas == nil {
+		return p.sess, false
+	}
+
+	if primary, _ := ctx.Value(primaryKey{}).(bool); primary {
+		return p.sess, false
+	}
+
+	if sess, ok := p.replicas.Session(); ok {
+		return sess, true
+	}
+
+	return p.sess, false
+}
@@ -0,0 +1,120 @@
+package upperdb
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/upperdb/upperdbtest"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+func TestNewReplicaPool(t *testing.T) {
+	if _, err := NewReplicaPool([]sqlbuilder.Database{upperdbtest.New()}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, err := NewReplicaPool(nil); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error without replicas, got %v", err)
+	}
+
+	if _, err := NewReplicaPool([]sqlbuilder.Database{upperdbtest.New()}, CheckInterval(0)); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error with zero check interval, got %v", err)
+	}
+}
+
+func TestReadReplicas(t *testing.T) {
+	primary := upperdbtest.New()
+	replica := upperdbtest.New()
+	defer ClearCache()
+
+	var lagging int32
+	pool, err := NewReplicaPool([]sqlbuilder.Database{replica}, HealthCheck(func(ctx context.Context, sess sqlbuilder.Database) error {
+		if atomic.LoadInt32(&lagging) == 1 {
+			return errors.E(errors.New("lagging"), errors.Transient)
+		}
+
+		return nil
+	}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mut, err := NewPartialMutation(
+		Values(storedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(primary),
+		ReadReplicas(pool),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := mut.InsertContext(ctx, primary, &storedResource{Name: "CAN"}, "name", "CAN", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := replica.InsertInto("resources").Columns("name").Values("MEX").ExecContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(ctx context.Context) []string {
+		var items []storedResource
+		if _, err := mut.ListContext(ctx, &items, "", "", nil, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, item := range items {
+			names = append(names, item.Name)
+		}
+
+		return names
+	}
+
+	var tests = []struct {
+		name     string
+		lagging  bool
+		ctx      context.Context
+		expected []string
+	}{
+		{
+			name:     "Healthy replica",
+			ctx:      ctx,
+			expected: []string{"MEX"},
+		},
+		{
+			name:     "Read from primary",
+			ctx:      ReadFromPrimary(ctx),
+			expected: []string{"CAN"},
+		},
+		{
+			name:     "Lagging replica",
+			lagging:  true,
+			ctx:      ctx,
+			expected: []string{"CAN"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&lagging, 0)
+			if tt.lagging {
+				atomic.StoreInt32(&lagging, 1)
+			}
+
+			pool.Check(ctx)
+
+			if got := list(tt.ctx); !cmp.Equal(tt.expected, got) {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
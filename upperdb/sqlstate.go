@@ -0,0 +1,135 @@
+package upperdb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mishudark/errors"
+)
+
+// SQLSTATE codes returned by Postgres, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	sqlStateNotNullViolation     = "23502"
+	sqlStateForeignKeyViolation  = "23503"
+	sqlStateUniqueViolation      = "23505"
+	sqlStateCheckViolation       = "23514"
+	sqlStateExclusionViolation   = "23P01"
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+	// sqlStateDataException is the class of the errors caused by invalid values, e.g. 22001 for
+	// a string that is too long for its column
+	sqlStateDataException = "22"
+)
+
+// translateError wraps a Postgres error with the kind of its SQLSTATE, and with the names of the
+// constraint, column and table as metadata, the errors without SQLSTATE are returned as they are
+func translateError(err error, operation, resource string) error {
+	driverErr := driverError(err)
+	if driverErr == nil {
+		return err
+	}
+
+	var (
+		kind   errors.Kind
+		reason string
+	)
+
+	code := driverErr.SQLState()
+	switch {
+	case code == sqlStateUniqueViolation || code == sqlStateExclusionViolation:
+		kind, reason = errors.Duplicated, "already exists"
+	case code == sqlStateForeignKeyViolation:
+		kind, reason = errors.Invalid, "referenced resource does not exist or is still referenced"
+	case code == sqlStateCheckViolation:
+		kind, reason = errors.Invalid, "check constraint violated"
+	case code == sqlStateNotNullViolation:
+		kind, reason = errors.Invalid, "required column is null"
+	case strings.HasPrefix(code, sqlStateDataException):
+		kind, reason = errors.Invalid, "invalid value"
+	case code == sqlStateSerializationFailure || code == sqlStateDeadlockDetected:
+		kind, reason = errors.Transient, "concurrent transaction conflict"
+	default:
+		return err
+	}
+
+	meta := errors.MetaData{"sqlstate": code}
+	for key, field := range map[string]struct {
+		code byte
+		name string
+	}{
+		"constraint": {'n', "ConstraintName"},
+		"column":     {'c', "ColumnName"},
+		"table":      {'t', "TableName"},
+	} {
+		if value := driverErrorField(driverErr, field.code, field.name); value != "" {
+			meta[key] = value
+		}
+	}
+
+	return errors.E(err, fmt.Sprintf("operation %s can not be performed, %s, resource %s", operation, reason, resource), kind, meta)
+}
+
+// sqlStater is implemented by the errors of the drivers that expose the SQLSTATE code, like
+// lib/pq and pgx
+type sqlStater interface {
+	error
+	SQLState() string
+}
+
+// driverError finds the driver error with a SQLSTATE code, wrapped errors are unwrapped with Cause
+// or Unwrap
+func driverError(err error) sqlStater {
+	for err != nil {
+		if e, ok := err.(sqlStater); ok {
+			return e
+		}
+
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// sqlState returns the SQLSTATE code of err, or an empty string if it has none
+func sqlState(err error) string {
+	if e := driverError(err); e != nil {
+		return e.SQLState()
+	}
+
+	return ""
+}
+
+// driverErrorField reads a field of a driver error, lib/pq errors are read with the Get method and
+// the code of the field, the errors of other drivers, like pgx, with the exported field name
+func driverErrorField(err error, code byte, name string) string {
+	if e, ok := err.(interface{ Get(byte) string }); ok {
+		return e.Get(code)
+	}
+
+	v := reflect.ValueOf(err)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+
+	if field := v.FieldByName(name); field.IsValid() && field.Kind() == reflect.String {
+		return field.String()
+	}
+
+	return ""
+}
@@ -0,0 +1,96 @@
+package upperdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+)
+
+// pqError is like the lib/pq errors, their fields are read with Get
+type pqError struct {
+	code   string
+	fields map[byte]string
+}
+
+func (e *pqError) Error() string     { return "pq: " + e.code }
+func (e *pqError) SQLState() string  { return e.code }
+func (e *pqError) Get(k byte) string { return e.fields[k] }
+
+// pgxError is like the pgx errors, their fields are exported
+type pgxError struct {
+	Code           string
+	ConstraintName string
+	ColumnName     string
+	TableName      string
+}
+
+func (e *pgxError) Error() string    { return "pgx: " + e.Code }
+func (e *pgxError) SQLState() string { return e.Code }
+
+func TestTranslateError(t *testing.T) {
+	var tests = []struct {
+		name         string
+		given        error
+		expectedKind errors.Kind
+		expectedMeta errors.MetaData
+	}{
+		{
+			name:         "Unique violation",
+			given:        &pqError{code: "23505", fields: map[byte]string{'n': "resources_name_key", 't': "resources"}},
+			expectedKind: errors.Duplicated,
+			expectedMeta: errors.MetaData{"sqlstate": "23505", "constraint": "resources_name_key", "table": "resources"},
+		},
+		{
+			name:         "Not null violation",
+			given:        &pgxError{Code: "23502", ColumnName: "display_name", TableName: "resources"},
+			expectedKind: errors.Invalid,
+			expectedMeta: errors.MetaData{"sqlstate": "23502", "column": "display_name", "table": "resources"},
+		},
+		{
+			name:         "Wrapped foreign key violation",
+			given:        errors.E(&pgxError{Code: "23503", ConstraintName: "resources_parent_fkey"}, "wrapped"),
+			expectedKind: errors.Invalid,
+			expectedMeta: errors.MetaData{"sqlstate": "23503", "constraint": "resources_parent_fkey"},
+		},
+		{
+			name:         "Data exception",
+			given:        &pgxError{Code: "22001"},
+			expectedKind: errors.Invalid,
+			expectedMeta: errors.MetaData{"sqlstate": "22001"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := translateError(tt.given, "insert", "CAN")
+
+			if !errors.IsKind(err, tt.expectedKind) {
+				t.Errorf("%s: expecting kind %s, got %v", tt.name, tt.expectedKind, err)
+			}
+
+			e, ok := err.(*errors.Error)
+			if !ok {
+				t.Fatalf("%s: expecting an *errors.Error, got %T", tt.name, err)
+			}
+
+			if equal := cmp.Equal(tt.expectedMeta, e.Meta); !equal {
+				diff := cmp.Diff(tt.expectedMeta, e.Meta)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			if sqlState(err) != sqlState(tt.given) {
+				t.Errorf("%s: expecting the SQLSTATE to be kept, got %s", tt.name, sqlState(err))
+			}
+		})
+	}
+}
+
+func TestTranslateErrorUnknown(t *testing.T) {
+	for _, given := range []error{fmt.Errorf("connection refused"), &pgxError{Code: "42P01"}} {
+		if err := translateError(given, "insert", "CAN"); err != given {
+			t.Errorf("expecting %v to be returned as it is, got %v", given, err)
+		}
+	}
+}
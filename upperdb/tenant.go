@@ -0,0 +1,79 @@
+package upperdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+)
+
+// ErrMissingTenant is the cause of the error returned when tenant scoping is enabled and the
+// context of the operation has no tenant, its kind is errors.Permission
+var ErrMissingTenant = errors.New("missing tenant")
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx that carries the given tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant carried by ctx
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// Tenant scopes every operation to the tenant of the context, see WithTenant. The rows are
+// filtered by the given column, and it is filled with the tenant on insert, the values provided
+// for it are ignored, and it is never updated. The operations without a tenant in their context
+// fail with ErrMissingTenant. The operations without context use the context of the session
+func Tenant(column string) Option {
+	return func(op *PartialMutation) {
+		op.tenantColumn = column
+	}
+}
+
+// validateTenant resolves the tenant column, it can be provided as a struct field name too
+func (p *PartialMutation) validateTenant() {
+	if column, _, ok := p.resolveField(p.tenantColumn); ok {
+		p.tenantColumn = column
+	}
+}
+
+// tenant returns the tenant of ctx, or an empty string if tenant scoping is disabled
+func (p *PartialMutation) tenant(ctx context.Context, operation string) (string, error) {
+	if p.tenantColumn == "" {
+		return "", nil
+	}
+
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return "", errors.E(ErrMissingTenant, fmt.Sprintf("operation %s can not be performed, the context has no tenant", operation), errors.Permission)
+	}
+
+	return tenant, nil
+}
+
+// tenantCond returns the condition that restricts a query to the tenant of ctx, it is empty if
+// tenant scoping is disabled
+func (p *PartialMutation) tenantCond(ctx context.Context, operation string) (db.Cond, error) {
+	tenant, err := p.tenant(ctx, operation)
+	if err != nil || tenant == "" {
+		return db.Cond{}, err
+	}
+
+	return db.Cond{p.tenantColumn: tenant}, nil
+}
+
+// withTenant replaces the tenant column of an insert with the tenant of ctx
+func (p *PartialMutation) withTenant(ctx context.Context, operation string, columns []string, values []interface{}) ([]string, []interface{}, error) {
+	tenant, err := p.tenant(ctx, operation)
+	if err != nil || tenant == "" {
+		return columns, values, err
+	}
+
+	columns, values = withoutColumn(columns, values, p.tenantColumn)
+	return append(columns, p.tenantColumn), append(values, tenant), nil
+}
@@ -0,0 +1,96 @@
+package upperdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/upperdb/upperdbtest"
+)
+
+type tenantResource struct {
+	ID       int64  `db:"id"`
+	TenantID string `db:"tenant_id"`
+	Name     string `db:"name"`
+	Quantity int    `db:"quantity"`
+}
+
+func TestTenant(t *testing.T) {
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(tenantResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+		ConflictColumns([]string{"name"}),
+		Tenant("TenantID"),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acme := WithTenant(context.Background(), "acme")
+	globex := WithTenant(context.Background(), "globex")
+
+	r := tenantResource{TenantID: "globex", Name: "CAN"}
+	if err := mut.InsertContext(acme, sess, &r, "name", "CAN", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.TenantID != "acme" {
+		t.Errorf("expecting the tenant of the context to be inserted, got %s", r.TenantID)
+	}
+
+	if err := mut.InsertContext(globex, sess, &tenantResource{Name: "MEX"}, "name", "MEX", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var items []tenantResource
+	if _, err := mut.ListContext(acme, &items, "", "", nil, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []tenantResource{{ID: 1, TenantID: "acme", Name: "CAN"}}
+	if equal := cmp.Equal(expected, items); !equal {
+		diff := cmp.Diff(expected, items)
+		t.Errorf("+got, -want, %s", diff)
+	}
+
+	update := tenantResource{TenantID: "acme", Quantity: 3}
+	if err := mut.UpdateContext(acme, sess, &update, "id", "2", []string{"Quantity", "TenantID"}, nil); !errors.IsKind(err, errors.NotExist) {
+		t.Errorf("expecting the row of another tenant to not exist, got %v", err)
+	}
+
+	if err := mut.UpsertContext(acme, sess, &tenantResource{Name: "MEX", Quantity: 3}, "MEX", nil); !errors.IsKind(err, errors.NotExist) {
+		t.Errorf("expecting the upsert to skip the row of another tenant, got %v", err)
+	}
+
+	if err := mut.DeleteContext(acme, sess, "id", "2"); !errors.IsKind(err, errors.NotExist) {
+		t.Errorf("expecting the delete to skip the row of another tenant, got %v", err)
+	}
+
+	if err := mut.UpdateContext(globex, sess, &update, "id", "2", []string{"Quantity", "TenantID"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if update.TenantID != "globex" || update.Quantity != 3 {
+		t.Errorf("expecting the tenant to not be updated, got %v", update)
+	}
+
+	for name, err := range map[string]error{
+		"insert": mut.InsertContext(context.Background(), sess, &tenantResource{Name: "USA"}, "name", "USA", nil),
+		"update": mut.UpdateContext(context.Background(), sess, &update, "id", "2", []string{"Quantity"}, nil),
+		"list": func() error {
+			_, err := mut.ListContext(context.Background(), &items, "", "", nil, 10)
+			return err
+		}(),
+	} {
+		if !errors.IsKind(err, errors.Permission) || errors.Cause(err) != ErrMissingTenant {
+			t.Errorf("%s: expecting a missing tenant error, got %v", name, err)
+		}
+	}
+}
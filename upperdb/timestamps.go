@@ -0,0 +1,79 @@
+package upperdb
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/mishudark/errors"
+)
+
+// Clock set the function used to get the current time, it stamps the autocreate and autoupdate
+// fields and the soft deleted rows, by default it is time.Now
+func Clock(clock func() time.Time) Option {
+	return func(op *PartialMutation) {
+		op.clock = clock
+	}
+}
+
+// validateTimestamps collects the fields tagged with the autocreate or autoupdate options, e.g.
+//
+//	CreateTime time.Time `db:"create_time,autocreate"`
+//	UpdateTime time.Time `db:"update_time,autoupdate"`
+//
+// they must be a time.Time or a *time.Time
+func (p *PartialMutation) validateTimestamps() error {
+	if p.clock == nil {
+		return errors.E(errors.New("PartialMutation, clock is required"), errors.Invalid)
+	}
+
+	for _, field := range p.fields {
+		if !field.autoCreate && !field.autoUpdate {
+			continue
+		}
+
+		fieldType := field.typ
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		if fieldType != timeType {
+			return errors.E(errors.Errorf("PartialMutation, timestamp field %s must be a time.Time", field.name), errors.Invalid)
+		}
+
+		if field.autoCreate {
+			p.autoCreateColumns = append(p.autoCreateColumns, field.column)
+		}
+
+		if field.autoUpdate {
+			p.autoUpdateColumns = append(p.autoUpdateColumns, field.column)
+		}
+	}
+
+	sort.Strings(p.autoCreateColumns)
+	sort.Strings(p.autoUpdateColumns)
+
+	return nil
+}
+
+// withTimestamps replaces the managed timestamps with the current time, the autocreate columns
+// are only set on insert, and the autoupdate columns are set on insert and update
+func (p *PartialMutation) withTimestamps(columns []string, values []interface{}, insert bool) ([]string, []interface{}) {
+	timestamps := p.autoUpdateColumns
+	if insert {
+		timestamps = append(append([]string{}, p.autoCreateColumns...), p.autoUpdateColumns...)
+	}
+
+	if len(timestamps) == 0 {
+		return columns, values
+	}
+
+	now := p.clock()
+	for _, column := range timestamps {
+		columns, values = withoutColumn(columns, values, column)
+		columns = append(columns, column)
+		values = append(values, now)
+	}
+
+	return columns, values
+}
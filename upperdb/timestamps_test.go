@@ -0,0 +1,93 @@
+package upperdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+)
+
+func TestTimestamps(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	mut, err := NewPartialMutation(
+		Values(Resource{}),
+		Include([]string{"Name", "CreateTime", "UpdateTime"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+		Clock(func() time.Time { return now }),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the timestamps provided by the client are ignored
+	past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &Resource{Name: "CAN", CreateTime: past, UpdateTime: past}
+
+	var tests = []struct {
+		name            string
+		run             func() ([]string, []interface{}, error)
+		expectedColumns []string
+		expectedValues  []interface{}
+	}{
+		{
+			name: "Insert",
+			run: func() ([]string, []interface{}, error) {
+				return mut.insertColumnsValues(r, map[string]interface{}{"update_time": past})
+			},
+			expectedColumns: []string{"name", "create_time", "update_time"},
+			expectedValues:  []interface{}{"CAN", now, now},
+		},
+		{
+			name: "Update",
+			run: func() ([]string, []interface{}, error) {
+				return mut.updateColumnsValues(r, []string{"Name", "CreateTime"}, nil)
+			},
+			expectedColumns: []string{"name", "update_time"},
+			expectedValues:  []interface{}{"CAN", now},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, values, err := tt.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if equal := cmp.Equal(tt.expectedColumns, columns); !equal {
+				diff := cmp.Diff(tt.expectedColumns, columns)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+
+			if equal := cmp.Equal(tt.expectedValues, values); !equal {
+				diff := cmp.Diff(tt.expectedValues, values)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+
+	if _, _, err := mut.updateColumnsValues(r, []string{"UpdateTime"}, nil); err == nil {
+		t.Errorf("expecting an error when only the managed timestamps are updated")
+	}
+}
+
+func TestTimestampsType(t *testing.T) {
+	type invalidResource struct {
+		Name       string `db:"name"`
+		CreateTime string `db:"create_time,autocreate"`
+	}
+
+	_, err := NewPartialMutation(
+		Values(invalidResource{}),
+		Include([]string{"Name"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+	)
+
+	if !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error, got %v", err)
+	}
+}
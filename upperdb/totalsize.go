@@ -0,0 +1,117 @@
+package upperdb
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/mishudark/errors"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// TotalSizeMode defines how List computes the total size of its results
+type TotalSizeMode int
+
+const (
+	// NoTotalSize skips the total size, it is the default
+	NoTotalSize TotalSizeMode = iota
+	// ExactTotalSize counts the rows that match the request with COUNT(*)
+	ExactTotalSize
+	// EstimatedTotalSize uses the row estimate of the Postgres planner, it is cheap on large
+	// tables, but it is only as accurate as the statistics of the table
+	EstimatedTotalSize
+)
+
+// TotalSize requests the total size of the List results, computed with the given mode
+func TotalSize(mode TotalSizeMode) ListOption {
+	return func(opts *listOptions) {
+		opts.totalSize = mode
+	}
+}
+
+// validate rejects the unknown modes
+func (m TotalSizeMode) validate() error {
+	switch m {
+	case NoTotalSize, ExactTotalSize, EstimatedTotalSize:
+		return nil
+	}
+
+	return errors.E(errors.Errorf("unknown total size mode %d", m), errors.Invalid)
+}
+
+// reltuplesQuery reads the estimated rows of a table, it is -1 when the table was never analyzed
+const reltuplesQuery = `SELECT reltuples::bigint FROM pg_class WHERE oid = ?::regclass`
+
+// totalSize returns the number of rows that match the given conditions
+func (p *PartialMutation) totalSize(ctx context.Context, sess sqlbuilder.Database, col DbCollection, conds [][]interface{}, mode TotalSizeMode) (int64, error) {
+	switch mode {
+	case ExactTotalSize:
+		query := col().Find()
+		if err := query.Err(); err != nil {
+			return 0, err
+		}
+
+		for _, cond := range conds {
+			query = query.And(cond...)
+		}
+
+		total, err := query.Count()
+		if err != nil {
+			return 0, translateError(err, "list", p.table)
+		}
+
+		return int64(total), nil
+	case EstimatedTotalSize:
+		return p.estimateTotalSize(ctx, sess, conds)
+	}
+
+	return 0, mode.validate()
+}
+
+// estimateTotalSize reads the estimated rows of the table from pg_class when there are no
+// conditions, otherwise the rows estimated by the plan of the query
+func (p *PartialMutation) estimateTotalSize(ctx context.Context, sess sqlbuilder.Database, conds [][]interface{}) (int64, error) {
+	if len(conds) == 0 {
+		row, err := sess.QueryRowContext(ctx, reltuplesQuery, quoteTable(p.table))
+		if err != nil {
+			return 0, translateError(err, "list", p.table)
+		}
+
+		var total int64
+		if err := row.Scan(&total); err != nil {
+			return 0, translateError(err, "list", p.table)
+		}
+
+		if total >= 0 {
+			return total, nil
+		}
+	}
+
+	query := sess.SelectFrom(p.table)
+	for _, cond := range conds {
+		query = query.And(cond...)
+	}
+
+	row, err := query.Amend(func(query string) string {
+		return "EXPLAIN (FORMAT JSON) " + query
+	}).QueryRowContext(ctx)
+	if err != nil {
+		return 0, translateError(err, "list", p.table)
+	}
+
+	var explain []byte
+	if err := row.Scan(&explain); err != nil {
+		return 0, translateError(err, "list", p.table)
+	}
+
+	var plans []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+
+	if err := json.Unmarshal(explain, &plans); err != nil || len(plans) == 0 {
+		return 0, errors.E(errors.Errorf("invalid query plan %s", explain), errors.Internal)
+	}
+
+	return int64(plans[0].Plan.Rows), nil
+}
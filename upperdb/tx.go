@@ -0,0 +1,142 @@
+package upperdb
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// DefaultTxRetries is the number of times RunInTx retries a transaction when TxOptions.MaxRetries is zero
+const DefaultTxRetries = 3
+
+var (
+	txBaseBackoff = 10 * time.Millisecond
+	txMaxBackoff  = time.Second
+)
+
+// TxOptions are the options of a transaction started by RunInTx
+type TxOptions struct {
+	// Isolation is the isolation level of the transaction, the default one of the database is used
+	// when it is sql.LevelDefault
+	Isolation sql.IsolationLevel
+	// ReadOnly starts a read only transaction
+	ReadOnly bool
+	// MaxRetries is the number of times the transaction is retried after a serialization failure
+	// or a deadlock, DefaultTxRetries is used when it is zero, and a negative value disables retries
+	MaxRetries int
+}
+
+// RunInTx runs fn inside a transaction, the transaction is committed when fn returns nil, and
+// rolled back otherwise. When the transaction fails with a serialization failure (40001) or a
+// deadlock (40P01), it is retried from the start after a jittered backoff, so fn must be safe
+// to run more than once. Every retry is recorded in metrics.TxRetries
+func RunInTx(ctx context.Context, sess sqlbuilder.Database, opts *TxOptions, fn func(tx sqlbuilder.Tx) error) error {
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+
+	setTx, err := setTransaction(opts)
+	if err != nil {
+		return err
+	}
+
+	maxRetries := opts.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultTxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, sess, setTx, fn)
+		code := sqlState(err)
+		if err == nil || attempt >= maxRetries || (code != sqlStateSerializationFailure && code != sqlStateDeadlockDetected) {
+			return err
+		}
+
+		if tagCtx, tagErr := tag.New(ctx, tag.Upsert(metrics.KeySQLState, code)); tagErr == nil {
+			stats.Record(tagCtx, metrics.TxRetries.M(1))
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.E(ctx.Err(), "RunInTx, the transaction can not be retried", errors.Transient)
+		case <-time.After(txBackoff(attempt)):
+		}
+	}
+}
+
+// runTx runs a single attempt of the transaction, it is rolled back if fn fails or panics
+func runTx(ctx context.Context, sess sqlbuilder.Database, setTx string, fn func(tx sqlbuilder.Tx) error) (err error) {
+	tx, err := sess.NewTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback() // nolint: errcheck
+			panic(p)
+		}
+	}()
+
+	if setTx != "" {
+		if _, err := tx.ExecContext(ctx, setTx); err != nil {
+			tx.Rollback() // nolint: errcheck
+			return err
+		}
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback() // nolint: errcheck
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setTransaction builds the SET TRANSACTION statement for the given options, it is empty when
+// the defaults of the database are used
+func setTransaction(opts *TxOptions) (string, error) {
+	var modes []string
+
+	switch opts.Isolation {
+	case sql.LevelDefault:
+	case sql.LevelReadUncommitted:
+		modes = append(modes, "ISOLATION LEVEL READ UNCOMMITTED")
+	case sql.LevelReadCommitted:
+		modes = append(modes, "ISOLATION LEVEL READ COMMITTED")
+	case sql.LevelRepeatableRead:
+		modes = append(modes, "ISOLATION LEVEL REPEATABLE READ")
+	case sql.LevelSerializable:
+		modes = append(modes, "ISOLATION LEVEL SERIALIZABLE")
+	default:
+		return "", errors.E(errors.Errorf("RunInTx, unsupported isolation level %s", opts.Isolation), errors.Invalid)
+	}
+
+	if opts.ReadOnly {
+		modes = append(modes, "READ ONLY")
+	}
+
+	if len(modes) == 0 {
+		return "", nil
+	}
+
+	return "SET TRANSACTION " + strings.Join(modes, ", "), nil
+}
+
+// txBackoff returns a random wait between zero and an exponential backoff of the given attempt
+func txBackoff(attempt int) time.Duration {
+	backoff := txMaxBackoff
+	if attempt < 16 && txBaseBackoff<<uint(attempt) < txMaxBackoff {
+		backoff = txBaseBackoff << uint(attempt)
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
@@ -0,0 +1,129 @@
+package upperdb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+// txDatabaseMock starts transactions that record the statements and how they ended
+type txDatabaseMock struct {
+	databaseMock
+	log []string
+}
+
+func (d *txDatabaseMock) NewTx(ctx context.Context) (sqlbuilder.Tx, error) {
+	d.log = append(d.log, "BEGIN")
+	return &txMock{db: d}, nil
+}
+
+type txMock struct {
+	sqlbuilder.Tx
+	db *txDatabaseMock
+}
+
+func (tx *txMock) ExecContext(ctx context.Context, query interface{}, args ...interface{}) (sql.Result, error) {
+	tx.db.log = append(tx.db.log, query.(string))
+	return nil, nil
+}
+
+func (tx *txMock) Commit() error {
+	tx.db.log = append(tx.db.log, "COMMIT")
+	return nil
+}
+
+func (tx *txMock) Rollback() error {
+	tx.db.log = append(tx.db.log, "ROLLBACK")
+	return nil
+}
+
+func TestRunInTx(t *testing.T) {
+	txBaseBackoff, txMaxBackoff = time.Microsecond, time.Microsecond
+
+	var tests = []struct {
+		name     string
+		opts     *TxOptions
+		errs     []error
+		expected []string
+		err      error
+	}{
+		{
+			name:     "Commit",
+			errs:     []error{nil},
+			expected: []string{"BEGIN", "COMMIT"},
+		},
+		{
+			name:     "Options",
+			opts:     &TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true},
+			errs:     []error{nil},
+			expected: []string{"BEGIN", "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY", "COMMIT"},
+		},
+		{
+			name:     "Retry serialization failure and deadlock",
+			errs:     []error{sqlStateError("40001"), errors.E(sqlStateError("40P01"), "wrapped"), nil},
+			expected: []string{"BEGIN", "ROLLBACK", "BEGIN", "ROLLBACK", "BEGIN", "COMMIT"},
+		},
+		{
+			name:     "Retries exhausted",
+			opts:     &TxOptions{MaxRetries: 1},
+			errs:     []error{sqlStateError("40001"), sqlStateError("40001")},
+			expected: []string{"BEGIN", "ROLLBACK", "BEGIN", "ROLLBACK"},
+			err:      sqlStateError("40001"),
+		},
+		{
+			name:     "Other errors are not retried",
+			errs:     []error{sqlStateError("23505")},
+			expected: []string{"BEGIN", "ROLLBACK"},
+			err:      sqlStateError("23505"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := &txDatabaseMock{}
+			attempt := 0
+
+			err := RunInTx(context.Background(), sess, tt.opts, func(tx sqlbuilder.Tx) error {
+				err := tt.errs[attempt]
+				attempt++
+				return err
+			})
+
+			if errors.Cause(err) != tt.err {
+				t.Errorf("%s: expecting error %v, got %v", tt.name, tt.err, err)
+			}
+
+			if equal := cmp.Equal(tt.expected, sess.log); !equal {
+				diff := cmp.Diff(tt.expected, sess.log)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestSetTransactionUnsupportedIsolation(t *testing.T) {
+	_, err := setTransaction(&TxOptions{Isolation: sql.LevelSnapshot})
+	if !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("expecting an invalid error, got %v", err)
+	}
+}
+
+func TestTxBackoff(t *testing.T) {
+	txBaseBackoff, txMaxBackoff = 10*time.Millisecond, time.Second
+
+	for attempt := 0; attempt < 100; attempt++ {
+		if backoff := txBackoff(attempt); backoff < 0 || backoff >= time.Second {
+			t.Errorf("attempt %d: backoff out of range, %s", attempt, backoff)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package upperdb
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	db "upper.io/db.v3"
 	"upper.io/db.v3/lib/sqlbuilder"
@@ -11,7 +13,13 @@ import (
 // nolint: deadcode,unused
 type DbCollection func() db.Collection
 
-var cache sync.Map
+// DefaultCacheTTL is the time that a collection stays in the cache of a session before its
+// existence is checked again
+var DefaultCacheTTL = 10 * time.Minute
+
+// caches holds the CollectionCache of every connection pool, the clones of a session made with
+// WithContext share the pool, so they share its cache, which is kept until ForgetSession is called
+var caches sync.Map
 
 // Ensure is a closure around ensureCollection
 func Ensure(sess sqlbuilder.Database, name string) DbCollection {
@@ -20,30 +28,177 @@ func Ensure(sess sqlbuilder.Database, name string) DbCollection {
 	}
 }
 
-// EnsureCollection checks in cache if the given name exists, if not it will
+// EnsureContext is like Ensure, but the returned collection runs its queries
+// on the given context
+func EnsureContext(ctx context.Context, sess sqlbuilder.Database, name string) DbCollection {
+	return func() db.Collection {
+		EnsureCollection(sess, name)
+		return sess.WithContext(ctx).Collection(name)
+	}
+}
+
+// EnsureCollection checks in the cache of the session if the given name exists, if not it will
 // ensure if the collection is available, otherwise it will clear session cache,
 // and will try to connect with collection again
 func EnsureCollection(sess sqlbuilder.Database, name string) db.Collection { // nolint: deadcode,unused
-	if collection, ok := cache.Load(name); ok {
-		return collection.(db.Collection)
+	return SessionCache(sess).Collection(name)
+}
+
+// ClearCache removes the cached collections of every session
+func ClearCache() {
+	caches.Range(func(key, val interface{}) bool {
+		caches.Delete(key)
+		return true
+	})
+}
+
+// ForgetSession removes the collection cache of the connection pool of the given session, it must
+// be called when the session is closed, otherwise the pool and its cache are never released. The
+// cache is created again if the session is used later
+func ForgetSession(sess sqlbuilder.Database) {
+	caches.Delete(cacheKey(sess))
+}
+
+// SessionCache returns the collection cache of the connection pool of the given session, it is
+// created on first use and kept until ForgetSession
+func SessionCache(sess sqlbuilder.Database) *CollectionCache {
+	key := cacheKey(sess)
+	if cache, ok := caches.Load(key); ok {
+		return cache.(*CollectionCache)
 	}
 
-	// if the collection exists, update cache
-	collection := sess.Collection(name)
-	if collection.Exists() {
-		cache.Store(name, collection)
-		return collection
+	// the cache outlives the context of the session that creates it
+	cache, _ := caches.LoadOrStore(key, &CollectionCache{
+		sess:    sess.WithContext(context.Background()),
+		ttl:     DefaultCacheTTL,
+		now:     time.Now,
+		entries: make(map[string]*cacheEntry),
+	})
+
+	return cache.(*CollectionCache)
+}
+
+// cacheKey returns the connection pool of sess, or sess itself when it has no driver
+func cacheKey(sess sqlbuilder.Database) interface{} {
+	if driver := sess.Driver(); driver != nil {
+		return driver
+	}
+
+	return sess
+}
+
+// CollectionCache caches the existing collections of a session, a collection is checked again
+// after the TTL, or after it is invalidated, e.g. when its table is dropped or renamed
+type CollectionCache struct {
+	sess    sqlbuilder.Database
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	collection db.Collection
+	exists     bool
+	expires    time.Time
+	// ready is closed when the existence of the collection is checked
+	ready chan struct{}
+}
+
+// SetTTL changes the time that the collections stay in the cache, zero or a negative value keeps
+// them until they are invalidated
+func (c *CollectionCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+}
+
+// Invalidate removes the given collection from the cache
+func (c *CollectionCache) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, name)
+}
+
+// Clear removes every collection from the cache
+func (c *CollectionCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*cacheEntry)
+}
+
+// Collection returns the cached collection, or checks if it exists, concurrent calls for a
+// collection that is not cached wait for a single check
+func (c *CollectionCache) Collection(name string) db.Collection {
+	c.mu.Lock()
+	if entry, ok := c.entries[name]; ok {
+		select {
+		case <-entry.ready:
+			if entry.exists && (c.ttl <= 0 || c.now().Before(entry.expires)) {
+				c.mu.Unlock()
+				recordCache(name, true)
+				return entry.collection
+			}
+		default:
+			// the existence is being checked by another call, it is not a miss
+			c.mu.Unlock()
+			<-entry.ready
+			recordCache(name, true)
+			return entry.collection
+		}
+	}
+
+	entry := &cacheEntry{ready: make(chan struct{})}
+	c.entries[name] = entry
+	ttl := c.ttl
+	c.mu.Unlock()
+
+	defer close(entry.ready)
+	recordCache(name, false)
+
+	entry.collection = c.sess.Collection(name)
+	if entry.collection.Exists() {
+		entry.exists = true
+		entry.expires = c.now().Add(ttl)
+		return entry.collection
 	}
 
 	// we asume that the collection does not exist
-	sess.ClearCache()
-	return collection
+	c.sess.ClearCache()
+
+	c.mu.Lock()
+	if c.entries[name] == entry {
+		delete(c.entries, name)
+	}
+	c.mu.Unlock()
+
+	return entry.collection
 }
 
-// ClearCache should be used only for tests
-func ClearCache() {
-	cache.Range(func(key, val interface{}) bool {
-		cache.Delete(key)
-		return true
-	})
+// bindContext returns a copy of sess that runs its queries on the given context,
+// both sessions and transactions are supported
+func bindContext(ctx context.Context, sess sqlbuilder.SQLBuilder) sqlbuilder.SQLBuilder {
+	switch s := sess.(type) {
+	case sqlbuilder.Tx:
+		return s.WithContext(ctx)
+	case sqlbuilder.Database:
+		return s.WithContext(ctx)
+	}
+
+	return sess
+}
+
+// sessionContext returns the default context of sess, or context.Background
+// if it has none
+func sessionContext(sess interface{}) context.Context {
+	if s, ok := sess.(interface{ Context() context.Context }); ok {
+		if ctx := s.Context(); ctx != nil {
+			return ctx
+		}
+	}
+
+	return context.Background()
 }
@@ -0,0 +1,192 @@
+package upperdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// collectionDatabaseMock returns collections that count the existence checks
+type collectionDatabaseMock struct {
+	databaseMock
+	exists bool
+	checks int32
+}
+
+func (d *collectionDatabaseMock) Collection(name string) db.Collection {
+	return &collectionMock{name: name, db: d}
+}
+
+func (d *collectionDatabaseMock) ClearCache() {}
+
+// Driver returns the mock itself, it is the connection pool of its clones
+func (d *collectionDatabaseMock) Driver() interface{} {
+	return d
+}
+
+func (d *collectionDatabaseMock) WithContext(context.Context) sqlbuilder.Database {
+	return d
+}
+
+type collectionMock struct {
+	db.Collection
+	name string
+	db   *collectionDatabaseMock
+}
+
+func (c *collectionMock) Name() string {
+	return c.name
+}
+
+func (c *collectionMock) Exists() bool {
+	atomic.AddInt32(&c.db.checks, 1)
+	time.Sleep(time.Millisecond)
+	return c.db.exists
+}
+
+func TestCollectionCacheFirstLoad(t *testing.T) {
+	sess := &collectionDatabaseMock{exists: true}
+	defer ClearCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if name := EnsureCollection(sess, "resources").Name(); name != "resources" {
+				t.Errorf("expecting the resources collection, got %s", name)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if checks := atomic.LoadInt32(&sess.checks); checks != 1 {
+		t.Errorf("expecting a single existence check, got %d", checks)
+	}
+}
+
+func TestCollectionCacheInvalidation(t *testing.T) {
+	sess := &collectionDatabaseMock{exists: true}
+	defer ClearCache()
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := SessionCache(sess)
+	cache.now = func() time.Time { return now }
+	cache.SetTTL(time.Minute)
+
+	var tests = []struct {
+		name     string
+		given    func()
+		expected int32
+	}{
+		{
+			name:     "Cached",
+			given:    func() {},
+			expected: 1,
+		},
+		{
+			name:     "Expired",
+			given:    func() { now = now.Add(2 * time.Minute) },
+			expected: 2,
+		},
+		{
+			name:     "Invalidated",
+			given:    func() { cache.Invalidate("resources") },
+			expected: 3,
+		},
+		{
+			name:     "Other session",
+			given:    func() { SessionCache(&collectionDatabaseMock{}).Clear() },
+			expected: 3,
+		},
+		{
+			name:     "Not exists",
+			given:    func() { sess.exists = false; cache.Clear() },
+			expected: 4,
+		},
+		{
+			name:     "Not exists is not cached",
+			given:    func() {},
+			expected: 5,
+		},
+	}
+
+	EnsureCollection(sess, "resources")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.given()
+			EnsureCollection(sess, "resources")
+
+			if checks := atomic.LoadInt32(&sess.checks); checks != tt.expected {
+				t.Errorf("%s: expecting %d existence checks, got %d", tt.name, tt.expected, checks)
+			}
+		})
+	}
+}
+
+func TestForgetSession(t *testing.T) {
+	sess := &collectionDatabaseMock{exists: true}
+	other := &collectionDatabaseMock{exists: true}
+	defer ClearCache()
+
+	EnsureCollection(sess, "resources")
+	EnsureCollection(other, "resources")
+
+	ForgetSession(sess)
+
+	if _, ok := caches.Load(sess); ok {
+		t.Errorf("expecting the cache of the session to be removed")
+	}
+
+	if _, ok := caches.Load(other); !ok {
+		t.Errorf("expecting the cache of other sessions to be kept")
+	}
+
+	EnsureCollection(sess, "resources")
+	if checks := atomic.LoadInt32(&sess.checks); checks != 2 {
+		t.Errorf("expecting the collection to be checked again, got %d checks", checks)
+	}
+}
+
+func TestSessionCacheClones(t *testing.T) {
+	_, sess := newRecorder(t)
+	defer ClearCache()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clone := sess.WithContext(ctx)
+	cache := SessionCache(clone)
+	cancel()
+
+	for i := 0; i < 10; i++ {
+		if SessionCache(sess.WithContext(context.Background())) != cache {
+			t.Fatalf("expecting the clones of a session to share its cache")
+		}
+	}
+
+	var n int
+	caches.Range(func(key, val interface{}) bool {
+		n++
+		return true
+	})
+
+	if n != 1 {
+		t.Errorf("expecting a single cache, got %d", n)
+	}
+
+	// the cache does not keep the canceled context of the clone that created it
+	if err := cache.sess.Context().Err(); err != nil {
+		t.Errorf("expecting the cache session not to be canceled, got %v", err)
+	}
+
+	ForgetSession(clone)
+	if _, ok := caches.Load(sess.Driver()); ok {
+		t.Errorf("expecting the cache of the connection pool to be removed")
+	}
+}
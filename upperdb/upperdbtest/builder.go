@@ -0,0 +1,951 @@
+package upperdbtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// builder implements the statements of sqlbuilder.SQLBuilder over a store
+type builder struct {
+	store *store
+}
+
+var (
+	rawIncrease = regexp.MustCompile(`^"?(\w+)"? \+ (\d+)$`)
+	// onConflict is the ON CONFLICT clause amended to an insert by the upserts of upperdb
+	onConflict      = regexp.MustCompile(`^ON CONFLICT \(([^)]+)\) DO UPDATE SET (.+?)(?: WHERE (.+))?$`)
+	quotedColumn    = regexp.MustCompile(`^"(\w+)"$`)
+	setExcluded     = regexp.MustCompile(`^"(\w+)" = EXCLUDED\."(\w+)"$`)
+	setIncrease     = regexp.MustCompile(`^"(\w+)" = (?:"\w+"\.)+"(\w+)" \+ (\d+)$`)
+	excludedEqual   = regexp.MustCompile(`^(?:"\w+"\.)+"(\w+)" = EXCLUDED\."(\w+)"$`)
+	returningSuffix = " RETURNING *"
+)
+
+// InsertInto starts an insert statement
+func (b builder) InsertInto(table string) sqlbuilder.Inserter {
+	return &inserter{b: b, table: table}
+}
+
+// Update starts an update statement
+func (b builder) Update(table string) sqlbuilder.Updater {
+	return &updater{b: b, table: table}
+}
+
+// DeleteFrom starts a delete statement
+func (b builder) DeleteFrom(table string) sqlbuilder.Deleter {
+	return &deleter{b: b, table: table}
+}
+
+// Select starts a select statement of the given columns, only column names and integer literals
+// are supported
+func (b builder) Select(columns ...interface{}) sqlbuilder.Selector {
+	return &selector{b: b, columns: columns}
+}
+
+// SelectFrom starts a select statement of every column of the given table
+func (b builder) SelectFrom(table ...interface{}) sqlbuilder.Selector {
+	return (&selector{b: b}).From(table...)
+}
+
+// Exec is like ExecContext with the background context
+func (b builder) Exec(query interface{}, args ...interface{}) (sql.Result, error) {
+	return b.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext accepts and ignores SET TRANSACTION, since the transactions are always
+// serializable, other raw statements are not supported
+func (b builder) ExecContext(ctx context.Context, query interface{}, args ...interface{}) (sql.Result, error) {
+	statement := fmt.Sprint(query)
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(statement)), "SET TRANSACTION") {
+		return result{}, nil
+	}
+
+	return nil, fmt.Errorf("upperdbtest: unsupported statement %q", statement)
+}
+
+// Iterator is like IteratorContext with the background context
+func (b builder) Iterator(query interface{}, args ...interface{}) sqlbuilder.Iterator {
+	return b.IteratorContext(context.Background(), query, args...)
+}
+
+// IteratorContext runs the statements compiled by the updaters of the same database, other raw
+// queries are not supported
+func (b builder) IteratorContext(ctx context.Context, query interface{}, args ...interface{}) sqlbuilder.Iterator {
+	if len(args) == 1 {
+		if u, ok := args[0].(*updater); ok && u.b.store == b.store {
+			return u.iterator(ctx, fmt.Sprint(query))
+		}
+	}
+
+	return errIterator(fmt.Errorf("upperdbtest: unsupported query %q", fmt.Sprint(query)))
+}
+
+// result is the sql.Result of a statement
+type result struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type inserter struct {
+	sqlbuilder.Inserter
+	b       builder
+	table   string
+	columns []string
+	values  [][]interface{}
+	amend   []func(string) string
+}
+
+func (i inserter) Columns(columns ...string) sqlbuilder.Inserter {
+	i.columns = append(i.columns[:len(i.columns):len(i.columns)], columns...)
+	return &i
+}
+
+func (i inserter) Values(values ...interface{}) sqlbuilder.Inserter {
+	i.values = append(i.values[:len(i.values):len(i.values)], values)
+	return &i
+}
+
+// Returning does nothing, the written rows are always returned by IteratorContext
+func (i inserter) Returning(columns ...string) sqlbuilder.Inserter {
+	return &i
+}
+
+// Amend appends to the statement RETURNING *, which does nothing, or the ON CONFLICT clause of
+// an upsert, the conflicting row is updated instead of inserted
+func (i inserter) Amend(fn func(string) string) sqlbuilder.Inserter {
+	i.amend = append(i.amend[:len(i.amend):len(i.amend)], fn)
+	return &i
+}
+
+func (i inserter) Arguments() []interface{} {
+	var args []interface{}
+	for _, values := range i.values {
+		args = append(args, values...)
+	}
+
+	return args
+}
+
+func (i inserter) String() string {
+	return fmt.Sprintf("INSERT INTO %q", i.table)
+}
+
+func (i inserter) Exec() (sql.Result, error) {
+	return i.ExecContext(context.Background())
+}
+
+func (i inserter) ExecContext(ctx context.Context) (sql.Result, error) {
+	_, rows, err := i.exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := result{rowsAffected: int64(len(rows))}
+	if len(rows) > 0 {
+		res.lastInsertID, _ = rows[len(rows)-1]["id"].(int64)
+	}
+
+	return res, nil
+}
+
+func (i inserter) Iterator() sqlbuilder.Iterator {
+	return i.IteratorContext(context.Background())
+}
+
+// IteratorContext runs the insert and returns the written rows
+func (i inserter) IteratorContext(ctx context.Context) sqlbuilder.Iterator {
+	columns, rows, err := i.exec(ctx)
+	if err != nil {
+		return errIterator(err)
+	}
+
+	return newIterator(columns, rows)
+}
+
+// exec writes the rows, the statement is atomic, if a row fails none is written
+func (i inserter) exec(ctx context.Context) ([]string, []Row, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	clause, err := i.conflict()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i.b.store.mu.Lock()
+	defer i.b.store.mu.Unlock()
+
+	t := i.b.store.table(i.table).clone()
+
+	var written []Row
+	for _, values := range i.values {
+		row, err := i.row(values)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, ok := row["id"]; !ok || row["id"] == nil {
+			t.serial++
+			row["id"] = t.serial
+		} else if id, ok := row["id"].(int64); ok && id > t.serial {
+			t.serial = id
+		}
+
+		t.addColumns(row)
+
+		existing := -1
+		if clause != nil {
+			for j, other := range t.rows {
+				if equalColumns(row, other, clause.columns) {
+					existing = j
+					break
+				}
+			}
+		}
+
+		if existing < 0 {
+			if err := i.b.store.checkUnique(i.table, t, row, -1); err != nil {
+				return nil, nil, err
+			}
+
+			t.rows = append(t.rows, row)
+			written = append(written, row)
+			continue
+		}
+
+		if !clause.matches(t.rows[existing], row) {
+			continue
+		}
+
+		updated, err := clause.apply(t.rows[existing], row)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := i.b.store.checkUnique(i.table, t, updated, existing); err != nil {
+			return nil, nil, err
+		}
+
+		t.rows[existing] = updated
+		written = append(written, updated)
+	}
+
+	i.b.store.tables[i.table] = t
+	return t.columns, copyRows(written), nil
+}
+
+// row builds a row from the columns and the values, a single map is used as the row
+func (i inserter) row(values []interface{}) (Row, error) {
+	if len(i.columns) == 0 && len(values) == 1 {
+		if m := reflect.ValueOf(values[0]); m.Kind() == reflect.Map && m.Type().Key().Kind() == reflect.String {
+			row := make(Row, m.Len())
+			for _, k := range m.MapKeys() {
+				value, err := storedValue(m.MapIndex(k).Interface())
+				if err != nil {
+					return nil, err
+				}
+
+				row[k.String()] = value
+			}
+
+			return row, nil
+		}
+	}
+
+	if len(values) != len(i.columns) {
+		return nil, fmt.Errorf("upperdbtest: insert into %q has %d columns and %d values", i.table, len(i.columns), len(values))
+	}
+
+	row := make(Row, len(values))
+	for j, column := range i.columns {
+		value, err := storedValue(values[j])
+		if err != nil {
+			return nil, err
+		}
+
+		row[column] = value
+	}
+
+	return row, nil
+}
+
+// conflict is the ON CONFLICT clause of an upsert
+type conflict struct {
+	columns []string
+	set     []conflictSet
+	where   []string
+}
+
+// conflictSet is an assignment of the ON CONFLICT clause, the column is set to the value of the
+// inserted row, or it is increased by n
+type conflictSet struct {
+	column   string
+	excluded bool
+	increase int64
+}
+
+// conflict reads the ON CONFLICT clause of the amended statement, it is nil when there is none
+func (i inserter) conflict() (*conflict, error) {
+	base := i.String()
+
+	statement := base
+	for _, fn := range i.amend {
+		statement = fn(statement)
+	}
+
+	if !strings.HasPrefix(statement, base) {
+		return nil, fmt.Errorf("upperdbtest: unsupported statement %q", statement)
+	}
+
+	clause := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(statement, base), returningSuffix))
+	if clause == "" {
+		return nil, nil
+	}
+
+	m := onConflict.FindStringSubmatch(clause)
+	if m == nil {
+		return nil, fmt.Errorf("upperdbtest: unsupported statement %q", statement)
+	}
+
+	c := &conflict{}
+	for _, column := range strings.Split(m[1], ", ") {
+		target := quotedColumn.FindStringSubmatch(column)
+		if target == nil {
+			return nil, fmt.Errorf("upperdbtest: unsupported conflict target %q", column)
+		}
+
+		c.columns = append(c.columns, target[1])
+	}
+
+	for _, assignment := range strings.Split(m[2], ", ") {
+		if set := setExcluded.FindStringSubmatch(assignment); set != nil && set[1] == set[2] {
+			c.set = append(c.set, conflictSet{column: set[1], excluded: true})
+			continue
+		}
+
+		if set := setIncrease.FindStringSubmatch(assignment); set != nil && set[1] == set[2] {
+			n, _ := strconv.ParseInt(set[3], 10, 64)
+			c.set = append(c.set, conflictSet{column: set[1], increase: n})
+			continue
+		}
+
+		return nil, fmt.Errorf("upperdbtest: unsupported conflict assignment %q", assignment)
+	}
+
+	if m[3] == "" {
+		return c, nil
+	}
+
+	for _, cond := range strings.Split(m[3], " AND ") {
+		equal := excludedEqual.FindStringSubmatch(cond)
+		if equal == nil || equal[1] != equal[2] {
+			return nil, fmt.Errorf("upperdbtest: unsupported conflict condition %q", cond)
+		}
+
+		c.where = append(c.where, equal[1])
+	}
+
+	return c, nil
+}
+
+// matches tells if the existing row satisfies the WHERE of the clause, otherwise it is not
+// updated nor returned
+func (c *conflict) matches(existing, row Row) bool {
+	return equalColumns(existing, row, c.where)
+}
+
+// apply returns the existing row updated with the assignments of the clause
+func (c *conflict) apply(existing, row Row) (Row, error) {
+	updated := existing.copy()
+	for _, set := range c.set {
+		if set.excluded {
+			updated[set.column] = row[set.column]
+			continue
+		}
+
+		value, err := add(existing[set.column], set.increase)
+		if err != nil {
+			return nil, err
+		}
+
+		updated[set.column] = value
+	}
+
+	return updated, nil
+}
+
+type setColumn struct {
+	column string
+	value  interface{}
+}
+
+type updater struct {
+	sqlbuilder.Updater
+	b     builder
+	table string
+	set   []setColumn
+	conds [][]interface{}
+	limit int
+	amend []func(string) string
+	err   error
+}
+
+// Set accepts a map of columns and values, or pairs of column and value
+func (u updater) Set(values ...interface{}) sqlbuilder.Updater {
+	u.set = u.set[:len(u.set):len(u.set)]
+
+	if len(values) == 1 {
+		m := reflect.ValueOf(values[0])
+		if m.Kind() != reflect.Map || m.Type().Key().Kind() != reflect.String {
+			u.err = fmt.Errorf("upperdbtest: unsupported set value %T", values[0])
+			return &u
+		}
+
+		for _, k := range m.MapKeys() {
+			u.set = append(u.set, setColumn{column: k.String(), value: m.MapIndex(k).Interface()})
+		}
+
+		return &u
+	}
+
+	if len(values)%2 != 0 {
+		u.err = fmt.Errorf("upperdbtest: set expects pairs of column and value")
+		return &u
+	}
+
+	for j := 0; j < len(values); j += 2 {
+		column, ok := values[j].(string)
+		if !ok || strings.ContainsAny(column, "?= ") {
+			u.err = fmt.Errorf("upperdbtest: unsupported set column %v", values[j])
+			return &u
+		}
+
+		u.set = append(u.set, setColumn{column: column, value: values[j+1]})
+	}
+
+	return &u
+}
+
+func (u updater) Where(conds ...interface{}) sqlbuilder.Updater {
+	u.conds = [][]interface{}{conds}
+	return &u
+}
+
+func (u updater) And(conds ...interface{}) sqlbuilder.Updater {
+	u.conds = append(u.conds[:len(u.conds):len(u.conds)], conds)
+	return &u
+}
+
+func (u updater) Limit(n int) sqlbuilder.Updater {
+	u.limit = n
+	return &u
+}
+
+func (u updater) String() string {
+	return fmt.Sprintf("UPDATE %q", u.table)
+}
+
+// Arguments returns the updater itself, the IteratorContext of its database runs the compiled
+// statement with it
+func (u updater) Arguments() []interface{} {
+	return []interface{}{&u}
+}
+
+// Amend appends to the statement, only RETURNING * is supported
+func (u updater) Amend(fn func(string) string) sqlbuilder.Updater {
+	u.amend = append(u.amend[:len(u.amend):len(u.amend)], fn)
+	return &u
+}
+
+// Compile returns the amended statement, it has no assignments nor conditions, they are applied
+// by the updater given as its argument
+func (u updater) Compile() (string, error) {
+	statement := u.String()
+	for _, fn := range u.amend {
+		statement = fn(statement)
+	}
+
+	return statement, nil
+}
+
+// iterator runs a compiled statement of the updater and returns the updated rows
+func (u updater) iterator(ctx context.Context, statement string) sqlbuilder.Iterator {
+	if compiled, _ := u.Compile(); statement != compiled || statement != u.String()+returningSuffix {
+		return errIterator(fmt.Errorf("upperdbtest: unsupported query %q", statement))
+	}
+
+	columns, rows, err := u.exec(ctx)
+	if err != nil {
+		return errIterator(err)
+	}
+
+	return newIterator(columns, rows)
+}
+
+func (u updater) Exec() (sql.Result, error) {
+	return u.ExecContext(context.Background())
+}
+
+func (u updater) ExecContext(ctx context.Context) (sql.Result, error) {
+	_, rows, err := u.exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return result{rowsAffected: int64(len(rows))}, nil
+}
+
+// exec updates the matching rows and returns them
+func (u updater) exec(ctx context.Context) ([]string, []Row, error) {
+	if u.err != nil {
+		return nil, nil, u.err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	u.b.store.mu.Lock()
+	defer u.b.store.mu.Unlock()
+
+	t := u.b.store.table(u.table).clone()
+
+	var written []Row
+	for j, row := range t.rows {
+		if u.limit > 0 && len(written) == u.limit {
+			break
+		}
+
+		ok, err := match(row, u.conds)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		updated := row.copy()
+		for _, s := range u.set {
+			value, err := u.value(row, s.value)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			updated[s.column] = value
+		}
+
+		t.addColumns(updated)
+		if err := u.b.store.checkUnique(u.table, t, updated, j); err != nil {
+			return nil, nil, err
+		}
+
+		t.rows[j] = updated
+		written = append(written, updated)
+	}
+
+	u.b.store.tables[u.table] = t
+	return t.columns, copyRows(written), nil
+}
+
+// value resolves the value of an assignment, the only supported raw value is "column" + n
+func (u updater) value(row Row, value interface{}) (interface{}, error) {
+	raw, ok := value.(db.RawValue)
+	if !ok {
+		return storedValue(value)
+	}
+
+	m := rawIncrease.FindStringSubmatch(raw.Raw())
+	if m == nil {
+		return nil, fmt.Errorf("upperdbtest: unsupported raw value %q", raw.Raw())
+	}
+
+	n, _ := strconv.ParseInt(m[2], 10, 64)
+	return add(row[m[1]], n)
+}
+
+type deleter struct {
+	sqlbuilder.Deleter
+	b     builder
+	table string
+	conds [][]interface{}
+	limit int
+}
+
+func (d deleter) Where(conds ...interface{}) sqlbuilder.Deleter {
+	d.conds = [][]interface{}{conds}
+	return &d
+}
+
+func (d deleter) And(conds ...interface{}) sqlbuilder.Deleter {
+	d.conds = append(d.conds[:len(d.conds):len(d.conds)], conds)
+	return &d
+}
+
+func (d deleter) Limit(n int) sqlbuilder.Deleter {
+	d.limit = n
+	return &d
+}
+
+func (d deleter) String() string {
+	return fmt.Sprintf("DELETE FROM %q", d.table)
+}
+
+func (d deleter) Arguments() []interface{} {
+	return nil
+}
+
+func (d deleter) Exec() (sql.Result, error) {
+	return d.ExecContext(context.Background())
+}
+
+func (d deleter) ExecContext(ctx context.Context) (sql.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	d.b.store.mu.Lock()
+	defer d.b.store.mu.Unlock()
+
+	t := d.b.store.get(d.table)
+
+	var (
+		kept    []Row
+		deleted int64
+	)
+
+	for _, row := range t.rows {
+		ok, err := match(row, d.conds)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok && (d.limit <= 0 || deleted < int64(d.limit)) {
+			deleted++
+			continue
+		}
+
+		kept = append(kept, row)
+	}
+
+	t.rows = kept
+	return result{rowsAffected: deleted}, nil
+}
+
+type selector struct {
+	sqlbuilder.Selector
+	b       builder
+	table   string
+	columns []interface{}
+	q       query
+	err     error
+}
+
+func (s selector) Columns(columns ...interface{}) sqlbuilder.Selector {
+	s.columns = append(s.columns[:len(s.columns):len(s.columns)], columns...)
+	return &s
+}
+
+func (s selector) From(tables ...interface{}) sqlbuilder.Selector {
+	if len(tables) != 1 {
+		s.err = fmt.Errorf("upperdbtest: select expects a single table, got %d", len(tables))
+		return &s
+	}
+
+	table, ok := tables[0].(string)
+	if !ok {
+		s.err = fmt.Errorf("upperdbtest: unsupported table %v", tables[0])
+		return &s
+	}
+
+	s.table = table
+	return &s
+}
+
+func (s selector) Where(conds ...interface{}) sqlbuilder.Selector {
+	s.q = s.q.where(conds)
+	return &s
+}
+
+func (s selector) And(conds ...interface{}) sqlbuilder.Selector {
+	s.q = s.q.and(conds)
+	return &s
+}
+
+func (s selector) OrderBy(columns ...interface{}) sqlbuilder.Selector {
+	s.q.orderBy = columns
+	return &s
+}
+
+func (s selector) Limit(n int) sqlbuilder.Selector {
+	s.q.limit = n
+	return &s
+}
+
+func (s selector) Offset(n int) sqlbuilder.Selector {
+	s.q.offset = n
+	return &s
+}
+
+// Amend is ignored, e.g. FOR UPDATE SKIP LOCKED, since the transactions work over their own copy
+// of the rows
+func (s selector) Amend(fn func(string) string) sqlbuilder.Selector {
+	return &s
+}
+
+func (s selector) String() string {
+	return fmt.Sprintf("SELECT FROM %q", s.table)
+}
+
+func (s selector) Arguments() []interface{} {
+	return nil
+}
+
+func (s selector) Iterator() sqlbuilder.Iterator {
+	return s.IteratorContext(context.Background())
+}
+
+func (s selector) IteratorContext(ctx context.Context) sqlbuilder.Iterator {
+	if s.err != nil {
+		return errIterator(s.err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errIterator(err)
+	}
+
+	s.b.store.mu.Lock()
+	defer s.b.store.mu.Unlock()
+
+	t := s.b.store.get(s.table)
+	rows, err := s.q.rows(t)
+	if err != nil {
+		return errIterator(err)
+	}
+
+	columns, rows, err := project(t.columns, rows, s.columns)
+	if err != nil {
+		return errIterator(err)
+	}
+
+	return newIterator(columns, rows)
+}
+
+func (s selector) All(dst interface{}) error {
+	return s.Iterator().All(dst)
+}
+
+func (s selector) One(dst interface{}) error {
+	return s.Iterator().One(dst)
+}
+
+// project keeps the selected columns, they can be column names, or integer literals selected
+// with db.Raw, e.g. db.Raw("1")
+func project(tableColumns []string, rows []Row, selected []interface{}) ([]string, []Row, error) {
+	if len(selected) == 0 || (len(selected) == 1 && selected[0] == "*") {
+		return tableColumns, rows, nil
+	}
+
+	columns := make([]string, len(selected))
+	literals := make(map[string]int64)
+	for i, c := range selected {
+		switch c := c.(type) {
+		case string:
+			columns[i] = c
+		case db.RawValue:
+			n, err := strconv.ParseInt(c.Raw(), 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("upperdbtest: unsupported raw column %q", c.Raw())
+			}
+
+			columns[i] = c.Raw()
+			literals[c.Raw()] = n
+		default:
+			return nil, nil, fmt.Errorf("upperdbtest: unsupported column %v", c)
+		}
+	}
+
+	projected := make([]Row, len(rows))
+	for i, row := range rows {
+		projected[i] = make(Row, len(columns))
+		for _, column := range columns {
+			if n, ok := literals[column]; ok {
+				projected[i][column] = n
+				continue
+			}
+
+			projected[i][column] = row[column]
+		}
+	}
+
+	return columns, projected, nil
+}
+
+// collection is a db.Collection of a table
+type collection struct {
+	db.Collection
+	builder
+	name string
+}
+
+func (c *collection) Name() string {
+	return c.name
+}
+
+// Exists returns true, the tables are created on the first insert
+func (c *collection) Exists() bool {
+	return true
+}
+
+func (c *collection) Find(conds ...interface{}) db.Result {
+	r := &findResult{b: c.builder, table: c.name}
+	if len(conds) > 0 {
+		r.q = r.q.where(conds)
+	}
+
+	return r
+}
+
+func (c *collection) Truncate() error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+
+	delete(c.store.tables, c.name)
+	return nil
+}
+
+// findResult is the db.Result of Collection.Find
+type findResult struct {
+	db.Result
+	b     builder
+	table string
+	q     query
+	// iter is the iterator used by Next
+	iter *iterator
+}
+
+func (r *findResult) clone() *findResult {
+	c := *r
+	c.iter = nil
+	return &c
+}
+
+func (r *findResult) Where(conds ...interface{}) db.Result {
+	c := r.clone()
+	c.q = c.q.where(conds)
+	return c
+}
+
+func (r *findResult) And(conds ...interface{}) db.Result {
+	c := r.clone()
+	c.q = c.q.and(conds)
+	return c
+}
+
+func (r *findResult) OrderBy(columns ...interface{}) db.Result {
+	c := r.clone()
+	c.q.orderBy = columns
+	return c
+}
+
+func (r *findResult) Limit(n int) db.Result {
+	c := r.clone()
+	c.q.limit = n
+	return c
+}
+
+func (r *findResult) Offset(n int) db.Result {
+	c := r.clone()
+	c.q.offset = n
+	return c
+}
+
+func (r *findResult) String() string {
+	return fmt.Sprintf("SELECT FROM %q", r.table)
+}
+
+func (r *findResult) selector() sqlbuilder.Selector {
+	return &selector{b: r.b, table: r.table, q: r.q}
+}
+
+func (r *findResult) One(dst interface{}) error {
+	return r.selector().One(dst)
+}
+
+func (r *findResult) All(dst interface{}) error {
+	return r.selector().All(dst)
+}
+
+// Count returns the number of matching rows, the limit and the offset are ignored
+func (r *findResult) Count() (uint64, error) {
+	r.b.store.mu.Lock()
+	defer r.b.store.mu.Unlock()
+
+	q := r.q
+	q.limit, q.offset, q.orderBy = 0, 0, nil
+
+	rows, err := q.rows(r.b.store.get(r.table))
+	return uint64(len(rows)), err
+}
+
+func (r *findResult) Exists() (bool, error) {
+	n, err := r.Count()
+	return n > 0, err
+}
+
+func (r *findResult) Delete() error {
+	_, err := (&deleter{b: r.b, table: r.table, conds: r.q.conds}).ExecContext(context.Background())
+	return err
+}
+
+func (r *findResult) Update(values interface{}) error {
+	_, err := (&updater{b: r.b, table: r.table, conds: r.q.conds}).Set(values).ExecContext(context.Background())
+	return err
+}
+
+func (r *findResult) Next(dst interface{}) bool {
+	if r.iter == nil {
+		r.iter = r.selector().Iterator().(*iterator)
+	}
+
+	return r.iter.Next(dst)
+}
+
+func (r *findResult) Err() error {
+	if r.iter == nil {
+		return nil
+	}
+
+	return r.iter.Err()
+}
+
+func (r *findResult) Close() error {
+	r.iter = nil
+	return nil
+}
+
+func copyRows(rows []Row) []Row {
+	copied := make([]Row, len(rows))
+	for i, row := range rows {
+		copied[i] = row.copy()
+	}
+
+	return copied
+}
@@ -0,0 +1,599 @@
+package upperdbtest
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	db "upper.io/db.v3"
+)
+
+// query holds the conditions, the order and the page of a select
+type query struct {
+	conds   [][]interface{}
+	orderBy []interface{}
+	limit   int
+	offset  int
+}
+
+func (q query) where(conds []interface{}) query {
+	q.conds = [][]interface{}{conds}
+	return q
+}
+
+func (q query) and(conds []interface{}) query {
+	q.conds = append(q.conds[:len(q.conds):len(q.conds)], conds)
+	return q
+}
+
+// rows returns the matching rows of t, sorted and paginated
+func (q query) rows(t *table) ([]Row, error) {
+	var rows []Row
+	for _, row := range t.rows {
+		ok, err := match(row, q.conds)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			rows = append(rows, row.copy())
+		}
+	}
+
+	if err := sortRows(rows, q.orderBy); err != nil {
+		return nil, err
+	}
+
+	if q.offset > 0 {
+		if q.offset > len(rows) {
+			q.offset = len(rows)
+		}
+
+		rows = rows[q.offset:]
+	}
+
+	if q.limit > 0 && q.limit < len(rows) {
+		rows = rows[:q.limit]
+	}
+
+	return rows, nil
+}
+
+// match tells if the row matches every group of conditions, a group is the arguments of a
+// Where or an And call
+func match(row Row, conds [][]interface{}) (bool, error) {
+	for _, args := range conds {
+		ok, err := matchArgs(row, args)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchArgs matches the arguments of a Where call, they are a column and a value, e.g.
+// Where("id", 1), or conditions like db.Cond, db.And and db.Or
+func matchArgs(row Row, args []interface{}) (bool, error) {
+	if len(args) == 0 {
+		return true, nil
+	}
+
+	if key, ok := args[0].(string); ok {
+		if strings.Contains(key, "?") || len(args) == 1 {
+			return false, fmt.Errorf("upperdbtest: unsupported raw condition %q", key)
+		}
+
+		var value interface{} = args[1:]
+		if len(args) == 2 {
+			value = args[1]
+		}
+
+		return matchConstraint(row, key, value)
+	}
+
+	for _, arg := range args {
+		ok, err := matchTerm(row, arg)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchTerm(row Row, term interface{}) (bool, error) {
+	switch t := term.(type) {
+	case nil:
+		return true, nil
+	case []interface{}:
+		return matchArgs(row, t)
+	case db.RawValue:
+		return false, fmt.Errorf("upperdbtest: unsupported raw condition %q", t.Raw())
+	case db.Cond:
+		for _, key := range t.Keys() {
+			ok, err := matchConstraint(row, key, t[key])
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+
+		return true, nil
+	case db.Constraint:
+		return matchConstraint(row, t.Key(), t.Value())
+	case db.Compound:
+		sentences := t.Sentences()
+		if t.Operator() == db.OperatorOr {
+			for _, sentence := range sentences {
+				ok, err := matchTerm(row, sentence)
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+
+			return len(sentences) == 0, nil
+		}
+
+		for _, sentence := range sentences {
+			ok, err := matchTerm(row, sentence)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	return false, fmt.Errorf("upperdbtest: unsupported condition %T", term)
+}
+
+var comparisonOperators = map[db.ComparisonOperator]string{
+	db.ComparisonOperatorEqual:                "=",
+	db.ComparisonOperatorNotEqual:             "!=",
+	db.ComparisonOperatorLessThan:             "<",
+	db.ComparisonOperatorGreaterThan:          ">",
+	db.ComparisonOperatorLessThanOrEqualTo:    "<=",
+	db.ComparisonOperatorGreaterThanOrEqualTo: ">=",
+	db.ComparisonOperatorIn:                   "IN",
+	db.ComparisonOperatorNotIn:                "NOT IN",
+	db.ComparisonOperatorIs:                   "IS",
+	db.ComparisonOperatorIsNot:                "IS NOT",
+	db.ComparisonOperatorLike:                 "LIKE",
+	db.ComparisonOperatorNotLike:              "NOT LIKE",
+}
+
+// matchConstraint evaluates a key of a db.Cond, the key is a column followed by an optional
+// operator, e.g. "quantity >", and the value can be a db.Comparison like db.Gt(3)
+func matchConstraint(row Row, key, value interface{}) (bool, error) {
+	k, ok := key.(string)
+	if !ok {
+		return false, fmt.Errorf("upperdbtest: unsupported condition key %v", key)
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(k), " ", 2)
+	column := strings.Trim(parts[0], `"`)
+
+	var operator string
+	if len(parts) == 2 {
+		operator = strings.ToUpper(strings.TrimSpace(parts[1]))
+	}
+
+	if comparison, ok := value.(db.Comparison); ok {
+		if operator, ok = comparisonOperators[comparison.Operator()]; !ok {
+			if custom, ok := comparison.(interface{ CustomOperator() string }); ok && custom.CustomOperator() != "" {
+				operator = strings.ToUpper(custom.CustomOperator())
+			} else {
+				return false, fmt.Errorf("upperdbtest: unsupported comparison of %s", column)
+			}
+		}
+
+		value = comparison.Value()
+	}
+
+	if operator == "" {
+		switch {
+		case value == nil:
+			operator = "IS"
+		case isList(value):
+			operator = "IN"
+		default:
+			operator = "="
+		}
+	}
+
+	return evaluate(row[column], operator, value)
+}
+
+// evaluate compares a stored value with the value of a condition, like Postgres a comparison
+// with null is false
+func evaluate(left interface{}, operator string, right interface{}) (bool, error) {
+	switch operator {
+	case "IS", "IS NOT":
+		var is bool
+		switch r := right.(type) {
+		case nil:
+			is = left == nil
+		case bool:
+			l, ok := left.(bool)
+			is = ok && l == r
+		default:
+			return false, fmt.Errorf("upperdbtest: unsupported IS value %v", right)
+		}
+
+		return is == (operator == "IS"), nil
+	case "IN", "NOT IN":
+		if left == nil || !isList(right) {
+			return false, nil
+		}
+
+		list := reflect.ValueOf(right)
+		found := false
+		for i := 0; i < list.Len() && !found; i++ {
+			c, err := compare(left, list.Index(i).Interface())
+			if err != nil {
+				return false, err
+			}
+
+			found = c == 0
+		}
+
+		return found == (operator == "IN"), nil
+	case "LIKE", "NOT LIKE", "ILIKE", "NOT ILIKE":
+		if left == nil {
+			return false, nil
+		}
+
+		pattern, ok := right.(string)
+		if !ok {
+			return false, fmt.Errorf("upperdbtest: unsupported %s pattern %v", operator, right)
+		}
+
+		text := fmt.Sprint(left)
+		if b, ok := left.([]byte); ok {
+			text = string(b)
+		}
+
+		matched := likeRegexp(pattern, strings.HasSuffix(operator, "ILIKE")).MatchString(text)
+		return matched == !strings.HasPrefix(operator, "NOT"), nil
+	}
+
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	c, err := compare(left, right)
+	if err != nil {
+		return false, err
+	}
+
+	switch operator {
+	case "=", "==":
+		return c == 0, nil
+	case "!=", "<>":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	}
+
+	return false, fmt.Errorf("upperdbtest: unsupported operator %s", operator)
+}
+
+func isList(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+
+	kind := reflect.TypeOf(value).Kind()
+	if kind == reflect.Array {
+		return true
+	}
+
+	_, isBytes := value.([]byte)
+	return kind == reflect.Slice && !isBytes
+}
+
+// likeRegexp converts a LIKE pattern to a regular expression, % matches any sequence, _ any
+// character, and \ escapes the next character
+func likeRegexp(pattern string, insensitive bool) *regexp.Regexp {
+	var b strings.Builder
+	if insensitive {
+		b.WriteString("(?i)")
+	}
+
+	b.WriteString("(?s)^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.MustCompile(b.String())
+}
+
+// sortRows sorts the rows by the given columns, a column prefixed with - is sorted in
+// descending order, like Postgres the nulls are sorted after the other values in ascending order
+func sortRows(rows []Row, orderBy []interface{}) error {
+	type order struct {
+		column string
+		desc   bool
+	}
+
+	orders := make([]order, 0, len(orderBy))
+	for _, o := range orderBy {
+		s, ok := o.(string)
+		if !ok {
+			return fmt.Errorf("upperdbtest: unsupported order %v", o)
+		}
+
+		fields := strings.Fields(s)
+		if len(fields) == 0 || len(fields) > 2 {
+			return fmt.Errorf("upperdbtest: unsupported order %q", s)
+		}
+
+		column := order{column: strings.Trim(strings.TrimPrefix(fields[0], "-"), `"`), desc: strings.HasPrefix(fields[0], "-")}
+		if len(fields) == 2 {
+			switch strings.ToUpper(fields[1]) {
+			case "ASC":
+			case "DESC":
+				column.desc = true
+			default:
+				return fmt.Errorf("upperdbtest: unsupported order %q", s)
+			}
+		}
+
+		orders = append(orders, column)
+	}
+
+	var err error
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, o := range orders {
+			a, b := rows[i][o.column], rows[j][o.column]
+
+			var c int
+			switch {
+			case a == nil && b == nil:
+				continue
+			case a == nil:
+				c = 1
+			case b == nil:
+				c = -1
+			default:
+				var cmpErr error
+				if c, cmpErr = compare(a, b); cmpErr != nil && err == nil {
+					err = cmpErr
+				}
+			}
+
+			if c == 0 {
+				continue
+			}
+
+			if o.desc {
+				return c > 0
+			}
+
+			return c < 0
+		}
+
+		return false
+	})
+
+	return err
+}
+
+// compare compares two not null values, values of different types are converted like Postgres
+// does with literals, e.g. a string is parsed when it is compared with an integer or a time
+func compare(a, b interface{}) (int, error) {
+	a, b = storedValueOrSelf(a), storedValueOrSelf(b)
+
+	if bytes, ok := a.([]byte); ok {
+		a = string(bytes)
+	}
+
+	if bytes, ok := b.([]byte); ok {
+		b = string(bytes)
+	}
+
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return compareInt(x, y), nil
+		case float64:
+			return compareFloat(float64(x), y), nil
+		case string:
+			return compareText(a, y)
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return compareFloat(x, float64(y)), nil
+		case float64:
+			return compareFloat(x, y), nil
+		case string:
+			return compareText(a, y)
+		}
+	case bool:
+		switch y := b.(type) {
+		case bool:
+			return compareBool(x, y), nil
+		case string:
+			return compareText(a, y)
+		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return compareTime(x, y), nil
+		case string:
+			return compareText(a, y)
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+
+		c, err := compareText(b, x)
+		return -c, err
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("upperdbtest: can not compare %T and %T", a, b)
+}
+
+// compareText compares a value with a text literal, it is parsed as the type of the value
+func compareText(value interface{}, text string) (int, error) {
+	switch v := value.(type) {
+	case int64:
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return compareInt(v, n), nil
+		}
+
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, fmt.Errorf("upperdbtest: invalid input syntax for integer %q", text)
+		}
+
+		return compareFloat(float64(v), f), nil
+	case float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, fmt.Errorf("upperdbtest: invalid input syntax for number %q", text)
+		}
+
+		return compareFloat(v, f), nil
+	case bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return 0, fmt.Errorf("upperdbtest: invalid input syntax for boolean %q", text)
+		}
+
+		return compareBool(v, b), nil
+	case time.Time:
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return 0, fmt.Errorf("upperdbtest: invalid input syntax for timestamp %q", text)
+		}
+
+		return compareTime(v, t), nil
+	}
+
+	return 0, fmt.Errorf("upperdbtest: can not compare %T and a string", value)
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+
+	return 1
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+
+	return 0
+}
+
+// add adds n to an integer value, like "column" + n
+func add(value interface{}, n int64) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		return v + n, nil
+	case float64:
+		return v + float64(n), nil
+	}
+
+	return nil, fmt.Errorf("upperdbtest: can not add %d to %T", n, value)
+}
+
+// storedValue converts a value to the value that is stored, the values are converted to driver
+// values, e.g. the integers to int64, and the driver.Valuer values with their Value method, the
+// values that are not supported by the drivers, like maps, are stored as they are
+func storedValue(value interface{}) (interface{}, error) {
+	if _, ok := value.(db.RawValue); ok {
+		return nil, fmt.Errorf("upperdbtest: unsupported raw value %v", value)
+	}
+
+	v, err := driver.DefaultParameterConverter.ConvertValue(value)
+	if err != nil {
+		if _, ok := value.(driver.Valuer); ok {
+			return nil, err
+		}
+
+		return value, nil
+	}
+
+	if b, ok := v.([]byte); ok {
+		return append([]byte(nil), b...), nil
+	}
+
+	return v, nil
+}
+
+// storedValueOrSelf is like storedValue, but a value that can not be converted is returned as
+// it is
+func storedValueOrSelf(value interface{}) interface{} {
+	if v, err := storedValue(value); err == nil {
+		return v
+	}
+
+	return value
+}
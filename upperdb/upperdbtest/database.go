@@ -0,0 +1,404 @@
+// Package upperdbtest provides an in-memory implementation of the parts of sqlbuilder.Database
+// and db.Collection used by upperdb, so a PartialMutation can be tested end to end without
+// Postgres, e.g.
+//
+//	sess := upperdbtest.New()
+//	mut, err := upperdb.NewPartialMutation(upperdb.Values(Resource{}), upperdb.Session(sess), ...)
+//
+// Supported are InsertInto (including RETURNING and the ON CONFLICT clause of Upsert), Update
+// (including RETURNING, run through Compile and IteratorContext), DeleteFrom, Select,
+// Collection.Find with OrderBy, Limit and Offset, One/All, and transactions.
+// The tables do not need to be created, they exist once a row is inserted, and the id column is
+// filled with a serial when it is not provided. The methods that are not supported panic
+package upperdbtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// Row is a stored row, its values are the driver values of the inserted ones (e.g. int64 for the
+// integers) and they are converted to the type of the destination when scanned
+type Row map[string]interface{}
+
+// Error is a constraint violation, it exposes the SQLSTATE code and the constraint name like the
+// errors of the Postgres drivers
+type Error struct {
+	Code           string
+	Message        string
+	TableName      string
+	ConstraintName string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("upperdbtest: %s (SQLSTATE %s)", e.Message, e.Code)
+}
+
+// SQLState returns the SQLSTATE code of the error
+func (e *Error) SQLState() string {
+	return e.Code
+}
+
+// Database is an in-memory sqlbuilder.Database, it is safe for concurrent use
+type Database struct {
+	unsupportedDatabase
+	builder
+	ctx context.Context
+}
+
+// unsupportedDatabase fills the methods of sqlbuilder.Database that are not implemented
+type unsupportedDatabase struct {
+	sqlbuilder.Database
+}
+
+// New returns an empty Database
+func New() *Database {
+	return &Database{
+		builder: builder{store: newStore()},
+		ctx:     context.Background(),
+	}
+}
+
+// Unique adds a unique constraint over the given columns, a write that duplicates the values of
+// another row fails with the SQLSTATE 23505, the rows with a null column are not checked
+func (d *Database) Unique(table, constraint string, columns ...string) {
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+
+	d.store.uniques[table] = append(d.store.uniques[table], unique{name: constraint, columns: columns})
+}
+
+// Rows returns a copy of the rows of a table, in insertion order
+func (d *Database) Rows(table string) []Row {
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+
+	t, ok := d.store.tables[table]
+	if !ok {
+		return nil
+	}
+
+	rows := make([]Row, len(t.rows))
+	for i, row := range t.rows {
+		rows[i] = row.copy()
+	}
+
+	return rows
+}
+
+// Name returns the name of the database
+func (d *Database) Name() string {
+	return "upperdbtest"
+}
+
+// Close does nothing, the rows are kept
+func (d *Database) Close() error {
+	return nil
+}
+
+// Collection returns a table, every table exists
+func (d *Database) Collection(name string) db.Collection {
+	return &collection{builder: d.builder, name: name}
+}
+
+// Collections returns the names of the tables with rows
+func (d *Database) Collections() ([]string, error) {
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+
+	names := make([]string, 0, len(d.store.tables))
+	for name := range d.store.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// ClearCache does nothing, there is no cache
+func (d *Database) ClearCache() {}
+
+// Context returns the default context of the session
+func (d *Database) Context() context.Context {
+	return d.ctx
+}
+
+// WithContext returns a copy of the session that shares the rows and uses the given context
+func (d *Database) WithContext(ctx context.Context) sqlbuilder.Database {
+	return &Database{builder: d.builder, ctx: ctx}
+}
+
+// Driver returns the rows of the database, they are shared by the copies made with WithContext
+func (d *Database) Driver() interface{} {
+	return d.store
+}
+
+// NewTx starts a transaction, it works over a copy of the rows, which replaces the rows of the
+// database on commit, so the transactions are serializable as long as they do not overlap
+func (d *Database) NewTx(ctx context.Context) (sqlbuilder.Tx, error) {
+	if ctx == nil {
+		ctx = d.ctx
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Tx{
+		builder: builder{store: d.store.clone()},
+		state:   &txState{parent: d.store},
+		ctx:     ctx,
+	}, nil
+}
+
+// Tx runs fn in a transaction, it is committed if fn returns nil and rolled back otherwise
+func (d *Database) Tx(ctx context.Context, fn func(sess sqlbuilder.Tx) error) error {
+	tx, err := d.NewTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback() // nolint: errcheck
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Tx is a transaction of a Database
+type Tx struct {
+	unsupportedTx
+	builder
+	state *txState
+	ctx   context.Context
+}
+
+// unsupportedTx fills the methods of sqlbuilder.Tx that are not implemented
+type unsupportedTx struct {
+	sqlbuilder.Tx
+}
+
+type txState struct {
+	mu     sync.Mutex
+	parent *store
+	done   bool
+}
+
+// Name returns the name of the database
+func (t *Tx) Name() string {
+	return "upperdbtest"
+}
+
+// Collection returns a table of the transaction
+func (t *Tx) Collection(name string) db.Collection {
+	return &collection{builder: t.builder, name: name}
+}
+
+// Context returns the default context of the transaction
+func (t *Tx) Context() context.Context {
+	return t.ctx
+}
+
+// WithContext returns a copy of the transaction that uses the given context
+func (t *Tx) WithContext(ctx context.Context) sqlbuilder.Tx {
+	return &Tx{builder: t.builder, state: t.state, ctx: ctx}
+}
+
+// Driver returns nil, there is no driver transaction
+func (t *Tx) Driver() interface{} {
+	return nil
+}
+
+// Commit replaces the rows of the database with the rows of the transaction
+func (t *Tx) Commit() error {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+
+	if t.state.done {
+		return errTxDone
+	}
+
+	t.state.done = true
+	t.state.parent.replace(t.store)
+	return nil
+}
+
+// Rollback discards the changes of the transaction
+func (t *Tx) Rollback() error {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+
+	if t.state.done {
+		return errTxDone
+	}
+
+	t.state.done = true
+	return nil
+}
+
+var errTxDone = fmt.Errorf("upperdbtest: transaction has already been committed or rolled back")
+
+// store holds the tables of a database or a transaction
+type store struct {
+	mu      sync.Mutex
+	tables  map[string]*table
+	uniques map[string][]unique
+}
+
+type table struct {
+	columns []string
+	rows    []Row
+	serial  int64
+}
+
+type unique struct {
+	name    string
+	columns []string
+}
+
+func newStore() *store {
+	return &store{
+		tables:  make(map[string]*table),
+		uniques: make(map[string][]unique),
+	}
+}
+
+// clone returns a deep copy of the store
+func (s *store) clone() *store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := newStore()
+	for name, t := range s.tables {
+		c.tables[name] = t.clone()
+	}
+
+	for name, uniques := range s.uniques {
+		c.uniques[name] = append([]unique(nil), uniques...)
+	}
+
+	return c
+}
+
+// replace sets the tables of s with the tables of other
+func (s *store) replace(other *store) {
+	other.mu.Lock()
+	tables := make(map[string]*table, len(other.tables))
+	for name, t := range other.tables {
+		tables[name] = t.clone()
+	}
+	other.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tables = tables
+}
+
+// table returns the table with the given name, it is created if it does not exist
+func (s *store) table(name string) *table {
+	t, ok := s.tables[name]
+	if !ok {
+		t = &table{}
+		s.tables[name] = t
+	}
+
+	return t
+}
+
+// get returns the table with the given name, or an empty table if it does not exist
+func (s *store) get(name string) *table {
+	if t, ok := s.tables[name]; ok {
+		return t
+	}
+
+	return &table{}
+}
+
+func (t *table) clone() *table {
+	c := &table{
+		columns: append([]string(nil), t.columns...),
+		rows:    make([]Row, len(t.rows)),
+		serial:  t.serial,
+	}
+
+	for i, row := range t.rows {
+		c.rows[i] = row.copy()
+	}
+
+	return c
+}
+
+// addColumns records the columns of a row, so the rows are returned with the columns in the
+// order they were first written
+func (t *table) addColumns(row Row) {
+	known := make(map[string]bool, len(t.columns))
+	for _, column := range t.columns {
+		known[column] = true
+	}
+
+	var added []string
+	for column := range row {
+		if !known[column] {
+			added = append(added, column)
+		}
+	}
+
+	sort.Strings(added)
+	t.columns = append(t.columns, added...)
+}
+
+// checkUnique returns an error if row duplicates the unique columns of a row of t, the row at
+// the index skip is not checked, since it is the one being updated
+func (s *store) checkUnique(name string, t *table, row Row, skip int) error {
+	for _, u := range s.uniques[name] {
+		for i, other := range t.rows {
+			if i == skip || !equalColumns(row, other, u.columns) {
+				continue
+			}
+
+			return &Error{
+				Code:           "23505",
+				Message:        fmt.Sprintf("duplicate key value violates unique constraint %q", u.name),
+				TableName:      name,
+				ConstraintName: u.name,
+			}
+		}
+	}
+
+	return nil
+}
+
+// equalColumns tells if the given columns have the same not null values in both rows
+func equalColumns(a, b Row, columns []string) bool {
+	for _, column := range columns {
+		if a[column] == nil || b[column] == nil {
+			return false
+		}
+
+		if c, err := compare(a[column], b[column]); err != nil || c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r Row) copy() Row {
+	c := make(Row, len(r))
+	for k, v := range r {
+		if b, ok := v.([]byte); ok {
+			v = append([]byte(nil), b...)
+		}
+
+		c[k] = v
+	}
+
+	return c
+}
@@ -0,0 +1,249 @@
+package upperdbtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+type resource struct {
+	ID         int64      `db:"id"`
+	Name       string     `db:"name"`
+	Quantity   int        `db:"quantity"`
+	DeleteTime *time.Time `db:"delete_time"`
+}
+
+func seed(t *testing.T, sess *Database) {
+	deleted := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	query := sess.InsertInto("resources").Columns("name", "quantity", "delete_time")
+	query = query.Values("CAN", 3, nil)
+	query = query.Values("MEX", 1, nil)
+	query = query.Values("USA", 5, deleted)
+	query = query.Values("ARG", 3, nil)
+
+	var inserted []resource
+	if err := query.Returning("*").IteratorContext(context.Background()).All(&inserted); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inserted) != 4 || inserted[3].ID != 4 || inserted[2].DeleteTime == nil || !inserted[2].DeleteTime.Equal(deleted) {
+		t.Fatalf("expecting the inserted rows with serial ids, got %v", inserted)
+	}
+}
+
+func TestFind(t *testing.T) {
+	sess := New()
+	seed(t, sess)
+
+	var tests = []struct {
+		name     string
+		given    func(db.Result) db.Result
+		expected []string
+	}{
+		{
+			name:     "Insertion order",
+			given:    func(r db.Result) db.Result { return r },
+			expected: []string{"CAN", "MEX", "USA", "ARG"},
+		},
+		{
+			name:     "Column and value",
+			given:    func(r db.Result) db.Result { return r.And("id", "2") },
+			expected: []string{"MEX"},
+		},
+		{
+			name:     "Operators",
+			given:    func(r db.Result) db.Result { return r.And(db.Cond{"quantity >=": 3, "name !=": "USA"}) },
+			expected: []string{"CAN", "ARG"},
+		},
+		{
+			name: "Or",
+			given: func(r db.Result) db.Result {
+				return r.And(db.Or(db.Cond{"name": db.Like("M%")}, db.Cond{"quantity": db.Gt(4)}))
+			},
+			expected: []string{"MEX", "USA"},
+		},
+		{
+			name:     "In",
+			given:    func(r db.Result) db.Result { return r.And(db.Cond{"name IN": []string{"ARG", "CAN"}}) },
+			expected: []string{"CAN", "ARG"},
+		},
+		{
+			name:     "Is null",
+			given:    func(r db.Result) db.Result { return r.And(db.Cond{"delete_time": db.IsNotNull()}) },
+			expected: []string{"USA"},
+		},
+		{
+			name:     "Order",
+			given:    func(r db.Result) db.Result { return r.OrderBy("-quantity", "name") },
+			expected: []string{"USA", "ARG", "CAN", "MEX"},
+		},
+		{
+			name:     "Nulls are last in ascending order",
+			given:    func(r db.Result) db.Result { return r.OrderBy("delete_time", "id") },
+			expected: []string{"USA", "CAN", "MEX", "ARG"},
+		},
+		{
+			name:     "Page",
+			given:    func(r db.Result) db.Result { return r.OrderBy("name").Offset(1).Limit(2) },
+			expected: []string{"CAN", "MEX"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rows []resource
+			if err := tt.given(sess.Collection("resources").Find()).All(&rows); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, row := range rows {
+				got = append(got, row.Name)
+			}
+
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	sess := New()
+	seed(t, sess)
+
+	query := sess.Update("resources").
+		Set(map[string]interface{}{"name": "BRA", "quantity": db.Raw(`"quantity" + 1`)}).
+		Where("id", 1).
+		And(db.Cond{"delete_time": db.IsNull()}).
+		Amend(func(query string) string {
+			return query + " RETURNING *"
+		})
+
+	statement, err := query.(*updater).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got resource
+	if err := sess.IteratorContext(context.Background(), statement, query.Arguments()...).One(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New().IteratorContext(context.Background(), statement, query.Arguments()...).One(&got); err == nil {
+		t.Errorf("expecting the statement to fail on another database")
+	}
+
+	expected := resource{ID: 1, Name: "BRA", Quantity: 4}
+	if equal := cmp.Equal(expected, got); !equal {
+		diff := cmp.Diff(expected, got)
+		t.Errorf("+got, -want, %s", diff)
+	}
+
+	res, err := sess.Update("resources").Set("quantity", 0).Where("id", 3).And(db.Cond{"delete_time": db.IsNull()}).ExecContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := res.RowsAffected(); n != 0 {
+		t.Errorf("expecting the deleted row to be skipped, got %d rows", n)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	sess := New()
+	seed(t, sess)
+
+	upsert := func(name string, quantity int, clause string) (resource, error) {
+		query := sess.InsertInto("resources").Columns("name", "quantity").Values(name, quantity).Amend(func(query string) string {
+			return query + " " + clause + " RETURNING *"
+		})
+
+		var row resource
+		err := query.IteratorContext(context.Background()).One(&row)
+		return row, err
+	}
+
+	got, err := upsert("MEX", 9, `ON CONFLICT ("name") DO UPDATE SET "quantity" = EXCLUDED."quantity"`)
+	if err != nil || got.ID != 2 || got.Quantity != 9 {
+		t.Errorf("expecting the existing row to be updated, got %v, %v", got, err)
+	}
+
+	got, err = upsert("MEX", 0, `ON CONFLICT ("name") DO UPDATE SET "quantity" = "resources"."quantity" + 1 WHERE "resources"."name" = EXCLUDED."name"`)
+	if err != nil || got.ID != 2 || got.Quantity != 10 {
+		t.Errorf("expecting the existing row to be increased, got %v, %v", got, err)
+	}
+
+	// like a sequence, every upsert takes an id, even the ones that update a row
+	got, err = upsert("BRA", 2, `ON CONFLICT ("name") DO UPDATE SET "quantity" = EXCLUDED."quantity"`)
+	if err != nil || got.ID != 7 || got.Quantity != 2 {
+		t.Errorf("expecting a new row, got %v, %v", got, err)
+	}
+
+	if _, err := upsert("BRA", 3, `ON CONFLICT ("name") DO NOTHING`); err == nil {
+		t.Errorf("expecting an unsupported clause to fail")
+	}
+}
+
+func TestUnique(t *testing.T) {
+	sess := New()
+	sess.Unique("resources", "resources_name_key", "name")
+	seed(t, sess)
+
+	_, err := sess.InsertInto("resources").Columns("name").Values("CAN").ExecContext(context.Background())
+
+	uniqueErr, ok := err.(*Error)
+	if !ok || uniqueErr.SQLState() != "23505" || uniqueErr.ConstraintName != "resources_name_key" {
+		t.Fatalf("expecting a unique violation, got %v", err)
+	}
+
+	if rows := sess.Rows("resources"); len(rows) != 4 {
+		t.Errorf("expecting the failed insert to write nothing, got %d rows", len(rows))
+	}
+}
+
+func TestTx(t *testing.T) {
+	sess := New()
+	seed(t, sess)
+
+	remove := func(tx sqlbuilder.Tx) error {
+		_, err := tx.DeleteFrom("resources").Where(db.Cond{"quantity <": 3}).ExecContext(context.Background())
+		return err
+	}
+
+	failed := errors.New("failed")
+	err := sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		if err := remove(tx); err != nil {
+			return err
+		}
+
+		if n, _ := tx.Collection("resources").Find().Count(); n != 3 {
+			t.Errorf("expecting the transaction to see its changes, got %d rows", n)
+		}
+
+		return failed
+	})
+
+	if err != failed {
+		t.Fatalf("expecting the error of the transaction, got %v", err)
+	}
+
+	if n, _ := sess.Collection("resources").Find().Count(); n != 4 {
+		t.Errorf("expecting the changes to be rolled back, got %d rows", n)
+	}
+
+	if err := sess.Tx(context.Background(), remove); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := sess.Collection("resources").Find().Count(); n != 3 {
+		t.Errorf("expecting the changes to be committed, got %d rows", n)
+	}
+}
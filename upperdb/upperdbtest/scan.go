@@ -0,0 +1,336 @@
+package upperdbtest
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/reflectx"
+)
+
+// mapper maps the columns to the struct fields with the db tag, like upper does
+var mapper = reflectx.NewMapper("db")
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// iterator is the sqlbuilder.Iterator of the rows returned by a statement
+type iterator struct {
+	columns []string
+	rows    []Row
+	// pos is the index of the current row
+	pos int
+	err error
+}
+
+func newIterator(columns []string, rows []Row) *iterator {
+	return &iterator{columns: columns, rows: rows, pos: -1}
+}
+
+func errIterator(err error) *iterator {
+	return &iterator{err: err, pos: -1}
+}
+
+// One scans the first row into dst, it returns db.ErrNoMoreRows if there are no rows
+func (it *iterator) One(dst interface{}) error {
+	if it.err != nil {
+		return it.err
+	}
+
+	if len(it.rows) == 0 {
+		return db.ErrNoMoreRows
+	}
+
+	return scanRow(dst, it.columns, it.rows[0])
+}
+
+// All scans every row into the slice pointed by dst
+func (it *iterator) All(dst interface{}) error {
+	if it.err != nil {
+		return it.err
+	}
+
+	dstv := reflect.ValueOf(dst)
+	if dstv.Kind() != reflect.Ptr || dstv.IsNil() || dstv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("upperdbtest: expecting a pointer to a slice but got %T", dst)
+	}
+
+	items := reflect.MakeSlice(dstv.Elem().Type(), 0, len(it.rows))
+	itemType := items.Type().Elem()
+	for _, row := range it.rows {
+		item := reflect.New(itemType)
+		if err := scanRow(item.Interface(), it.columns, row); err != nil {
+			return err
+		}
+
+		items = reflect.Append(items, item.Elem())
+	}
+
+	dstv.Elem().Set(items)
+	return nil
+}
+
+// Next moves to the next row, and scans it into dst when it is given, a single destination is
+// scanned like One, and many like Scan
+func (it *iterator) Next(dst ...interface{}) bool {
+	if it.err != nil || it.pos+1 >= len(it.rows) {
+		return false
+	}
+
+	it.pos++
+
+	switch len(dst) {
+	case 0:
+	case 1:
+		it.err = scanRow(dst[0], it.columns, it.rows[it.pos])
+	default:
+		it.err = it.Scan(dst...)
+	}
+
+	return it.err == nil
+}
+
+// Scan scans the columns of the current row into dst, in order
+func (it *iterator) Scan(dst ...interface{}) error {
+	if it.err != nil {
+		return it.err
+	}
+
+	if it.pos < 0 || it.pos >= len(it.rows) {
+		return db.ErrNoMoreRows
+	}
+
+	if len(dst) != len(it.columns) {
+		return fmt.Errorf("upperdbtest: expecting %d destinations but got %d", len(it.columns), len(dst))
+	}
+
+	for i, column := range it.columns {
+		v := reflect.ValueOf(dst[i])
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return fmt.Errorf("upperdbtest: expecting a pointer but got %T", dst[i])
+		}
+
+		if err := assign(v.Elem(), it.rows[it.pos][column]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NextScan moves to the next row and scans it into dst
+func (it *iterator) NextScan(dst ...interface{}) error {
+	if !it.Next() {
+		if it.err != nil {
+			return it.err
+		}
+
+		return db.ErrNoMoreRows
+	}
+
+	return it.Scan(dst...)
+}
+
+// ScanOne scans the first row into dst
+func (it *iterator) ScanOne(dst ...interface{}) error {
+	defer it.Close() // nolint: errcheck
+	return it.NextScan(dst...)
+}
+
+func (it *iterator) Err() error {
+	return it.err
+}
+
+func (it *iterator) Close() error {
+	return nil
+}
+
+// scanRow scans a row into a pointer to a struct, a map or a single value
+func scanRow(dst interface{}, columns []string, row Row) error {
+	dstv := reflect.ValueOf(dst)
+	if dstv.Kind() != reflect.Ptr || dstv.IsNil() {
+		return fmt.Errorf("upperdbtest: expecting a pointer but got %T", dst)
+	}
+
+	item := dstv.Elem()
+	item.Set(reflect.Zero(item.Type()))
+
+	if item.Kind() == reflect.Ptr {
+		item.Set(reflect.New(item.Type().Elem()))
+		item = item.Elem()
+	}
+
+	switch {
+	case item.Kind() == reflect.Map && item.Type().Key().Kind() == reflect.String:
+		m := reflect.MakeMapWithSize(item.Type(), len(columns))
+		for _, column := range columns {
+			value := reflect.New(item.Type().Elem()).Elem()
+			if err := assign(value, row[column]); err != nil {
+				return err
+			}
+
+			m.SetMapIndex(reflect.ValueOf(column).Convert(item.Type().Key()), value)
+		}
+
+		item.Set(m)
+		return nil
+	case item.Kind() == reflect.Struct && item.Type() != timeType && !isScanner(item):
+		for i, traversal := range mapper.TraversalsByName(item.Type(), columns) {
+			if len(traversal) == 0 {
+				continue
+			}
+
+			if err := assign(reflectx.FieldByIndexes(item, traversal), row[columns[i]]); err != nil {
+				return fmt.Errorf("upperdbtest: column %s, %v", columns[i], err)
+			}
+		}
+
+		return nil
+	}
+
+	if len(columns) == 0 {
+		return nil
+	}
+
+	return assign(item, row[columns[0]])
+}
+
+func isScanner(v reflect.Value) bool {
+	if !v.CanAddr() {
+		return false
+	}
+
+	_, ok := v.Addr().Interface().(sql.Scanner)
+	return ok
+}
+
+// assign sets a stored value into dst, converting it like database/sql does when it scans a
+// column, the sql.Scanner destinations scan the value themselves
+func assign(dst reflect.Value, src interface{}) error {
+	if dst.CanAddr() {
+		if scanner, ok := dst.Addr().Interface().(sql.Scanner); ok {
+			return scanner.Scan(src)
+		}
+	}
+
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	if dst.Kind() == reflect.Ptr {
+		value := reflect.New(dst.Type().Elem())
+		if err := assign(value.Elem(), src); err != nil {
+			return err
+		}
+
+		dst.Set(value)
+		return nil
+	}
+
+	srcv := reflect.ValueOf(src)
+	if b, ok := src.([]byte); ok {
+		srcv = reflect.ValueOf(append([]byte(nil), b...))
+	}
+
+	if srcv.Type().AssignableTo(dst.Type()) {
+		dst.Set(srcv)
+		return nil
+	}
+
+	text, isText := src.(string)
+	if b, ok := src.([]byte); ok {
+		text, isText = string(b), true
+	}
+
+	switch dst.Kind() {
+	case reflect.String:
+		switch s := src.(type) {
+		case string, []byte:
+			dst.SetString(text)
+		case time.Time:
+			dst.SetString(s.Format(time.RFC3339Nano))
+		default:
+			dst.SetString(fmt.Sprint(s))
+		}
+
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toInt(src, text, isText)
+		if err != nil || dst.OverflowInt(n) {
+			return fmt.Errorf("converting %T to %s", src, dst.Type())
+		}
+
+		dst.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toInt(src, text, isText)
+		if err != nil || n < 0 || dst.OverflowUint(uint64(n)) {
+			return fmt.Errorf("converting %T to %s", src, dst.Type())
+		}
+
+		dst.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch s := src.(type) {
+		case int64:
+			f = float64(s)
+		case float64:
+			f = s
+		default:
+			var err error
+			if f, err = strconv.ParseFloat(text, 64); !isText || err != nil {
+				return fmt.Errorf("converting %T to %s", src, dst.Type())
+			}
+		}
+
+		dst.SetFloat(f)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if !isText || err != nil {
+			return fmt.Errorf("converting %T to %s", src, dst.Type())
+		}
+
+		dst.SetBool(b)
+		return nil
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 && isText {
+			dst.SetBytes([]byte(text))
+			return nil
+		}
+	case reflect.Struct:
+		if dst.Type() == timeType && isText {
+			t, err := time.Parse(time.RFC3339Nano, text)
+			if err != nil {
+				return fmt.Errorf("converting %q to %s", text, dst.Type())
+			}
+
+			dst.Set(reflect.ValueOf(t))
+			return nil
+		}
+	}
+
+	if srcv.Kind() == dst.Kind() && srcv.Type().ConvertibleTo(dst.Type()) {
+		dst.Set(srcv.Convert(dst.Type()))
+		return nil
+	}
+
+	return fmt.Errorf("converting %T to %s", src, dst.Type())
+}
+
+// toInt converts an integer, or a text with an integer
+func toInt(src interface{}, text string, isText bool) (int64, error) {
+	if n, ok := src.(int64); ok {
+		return n, nil
+	}
+
+	if !isText {
+		return 0, fmt.Errorf("not an integer")
+	}
+
+	return strconv.ParseInt(text, 10, 64)
+}
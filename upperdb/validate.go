@@ -0,0 +1,155 @@
+package upperdb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/mishudark/errors"
+)
+
+// validateResource runs the validation of structPtr when it implements validation.Validatable,
+// only the errors of the given fields are kept, all of them when fields is nil. The failures are
+// returned as errors.Invalid, with the message of each invalid field as metadata
+func (p *PartialMutation) validateResource(operation string, structPtr interface{}, fields []string) error {
+	fieldErrors, err := p.validate(operation, structPtr, fields)
+	if err != nil || len(fieldErrors) == 0 {
+		return err
+	}
+
+	meta := make(errors.MetaData)
+	for key, fieldErr := range fieldErrors {
+		meta[key] = fieldErr.Error()
+	}
+
+	return errors.E(fieldErrors, fmt.Sprintf("operation %s can not be performed, invalid resource", operation), errors.Invalid, meta)
+}
+
+// validateResources runs the validation of each element of slicePtr, the metadata keys are
+// prefixed with the index of the element, e.g. 2.name
+func (p *PartialMutation) validateResources(operation string, slicePtr interface{}) error {
+	if slicePtr == nil || reflect.TypeOf(slicePtr).Kind() != reflect.Ptr || reflect.TypeOf(slicePtr).Elem().Kind() != reflect.Slice {
+		return nil
+	}
+
+	meta := make(errors.MetaData)
+	items := reflect.ValueOf(slicePtr).Elem()
+	for i := 0; i < items.Len(); i++ {
+		item := items.Index(i)
+		if item.Kind() != reflect.Ptr {
+			item = item.Addr()
+		}
+
+		if item.IsNil() {
+			continue
+		}
+
+		fieldErrors, err := p.validate(operation, item.Interface(), nil)
+		if err != nil {
+			return err
+		}
+
+		for key, fieldErr := range fieldErrors {
+			meta[fmt.Sprintf("%d.%s", i, key)] = fieldErr.Error()
+		}
+	}
+
+	if len(meta) == 0 {
+		return nil
+	}
+
+	return errors.E(errors.Errorf("%d invalid fields", len(meta)), fmt.Sprintf("operation %s can not be performed, invalid resources", operation), errors.Invalid, meta)
+}
+
+// validate returns the field errors of structPtr, the errors that are not attached to a field
+// are returned as errors.Invalid, and the internal errors of the rules as errors.Internal
+func (p *PartialMutation) validate(operation string, structPtr interface{}, fields []string) (validation.Errors, error) {
+	validatable, ok := structPtr.(validation.Validatable)
+	if !ok {
+		return nil, nil
+	}
+
+	err := validatable.Validate()
+	if err == nil {
+		return nil, nil
+	}
+
+	if internal, ok := err.(validation.InternalError); ok {
+		return nil, errors.E(internal.InternalError(), fmt.Sprintf("operation %s can not be performed, validation failed", operation), errors.Internal)
+	}
+
+	fieldErrors, ok := err.(validation.Errors)
+	if !ok {
+		return nil, errors.E(err, fmt.Sprintf("operation %s can not be performed, invalid resource", operation), errors.Invalid)
+	}
+
+	if fields != nil {
+		return p.maskedErrors(fieldErrors, fields), nil
+	}
+
+	return fieldErrors, nil
+}
+
+// validateUpdate runs the validation of structPtr for the fields changed by an update
+func (p *PartialMutation) validateUpdate(structPtr interface{}, fieldMask []string) error {
+	if _, ok := structPtr.(validation.Validatable); !ok {
+		return nil
+	}
+
+	// an invalid field mask is reported by the update itself
+	columns, _, err := p.updateColumnsValues(structPtr, fieldMask, nil)
+	if err != nil {
+		return nil
+	}
+
+	fields := []string{}
+	for _, column := range columns {
+		if field, ok := p.columnsMap[column]; ok && !p.fields[field].autoCreate && !p.fields[field].autoUpdate {
+			fields = append(fields, field)
+		}
+	}
+
+	return p.validateResource("update", structPtr, fields)
+}
+
+// maskedErrors keeps the errors of the given fields
+func (p *PartialMutation) maskedErrors(fieldErrors validation.Errors, fields []string) validation.Errors {
+	keys := make(map[string]bool)
+	for _, field := range fields {
+		keys[p.errorKey(field)] = true
+	}
+
+	masked := make(validation.Errors)
+	for key, err := range fieldErrors {
+		if keys[key] {
+			masked[key] = err
+		}
+	}
+
+	return masked
+}
+
+// errorKey returns the key used by validation.ValidateStruct for the errors of a field, the json
+// name of the outermost named struct field, the fields of anonymous embedded structs are promoted
+func (p *PartialMutation) errorKey(field string) string {
+	t := p.structType
+	for _, i := range p.fields[field].index {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		f := t.Field(i)
+		if !f.Anonymous {
+			if tag := strings.SplitN(f.Tag.Get(validation.ErrorTag), ",", 2)[0]; tag != "" {
+				return tag
+			}
+
+			return f.Name
+		}
+
+		t = f.Type
+	}
+
+	return field
+}
@@ -0,0 +1,99 @@
+package upperdb
+
+import (
+	"testing"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	"github.com/mishudark/kitten/upperdb/upperdbtest"
+)
+
+type validatedResource struct {
+	ID          int64  `db:"id" json:"id"`
+	Name        string `db:"name" json:"name"`
+	DisplayName string `db:"display_name" json:"display_name"`
+	Quantity    int    `db:"quantity"`
+}
+
+func (r validatedResource) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Name, validation.Required),
+		validation.Field(&r.DisplayName, validation.Length(0, 6)),
+		validation.Field(&r.Quantity, validation.Min(0)),
+	)
+}
+
+func TestValidate(t *testing.T) {
+	sess := upperdbtest.New()
+	defer ClearCache()
+
+	mut, err := NewPartialMutation(
+		Values(validatedResource{}),
+		Exclude([]string{"ID"}),
+		Table("resources"),
+		Session(sess),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		given    func() error
+		expected errors.MetaData
+	}{
+		{
+			name: "Insert",
+			given: func() error {
+				return mut.Insert(sess, &validatedResource{DisplayName: "Canada", Quantity: -1}, "name", "", nil)
+			},
+			expected: errors.MetaData{"name": "cannot be blank", "Quantity": "must be no less than 0"},
+		},
+		{
+			name: "Insert many",
+			given: func() error {
+				return mut.InsertMany(sess, &[]validatedResource{{Name: "CAN"}, {DisplayName: "Mexico!"}}, nil)
+			},
+			expected: errors.MetaData{"1.name": "cannot be blank", "1.display_name": "the length must be no more than 6"},
+		},
+		{
+			name: "Update with field mask",
+			given: func() error {
+				return mut.Update(sess, &validatedResource{DisplayName: "Mexico!", Quantity: -1}, "id", "1", []string{"DisplayName"}, nil)
+			},
+			expected: errors.MetaData{"display_name": "the length must be no more than 6"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.given()
+			if !errors.IsKind(err, errors.Invalid) {
+				t.Fatalf("%s: expecting an invalid error, got %v", tt.name, err)
+			}
+
+			got := err.(*errors.Error).Meta
+			if equal := cmp.Equal(tt.expected, got); !equal {
+				diff := cmp.Diff(tt.expected, got)
+				t.Errorf("%s: +got, -want, %s", tt.name, diff)
+			}
+		})
+	}
+
+	if rows := sess.Rows("resources"); len(rows) != 0 {
+		t.Errorf("expecting the invalid resources to not be written, got %d rows", len(rows))
+	}
+
+	r := validatedResource{Name: "MEX", Quantity: 1}
+	if err := mut.Insert(sess, &r, "name", "MEX", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the invalid name is out of the field mask
+	update := validatedResource{DisplayName: "Mexico", Quantity: 2}
+	if err := mut.Update(sess, &update, "id", "1", []string{"DisplayName", "Quantity"}, nil); err != nil {
+		t.Errorf("expecting the fields out of the mask to not be validated, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package upperdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// ErrStaleVersion is the cause of the error returned by Update when the version of the
+// provided values does not match the stored one. Its kind is errors.Duplicated, which is
+// mapped to 409 Conflict, the same kind of the unique violations, so callers must compare
+// errors.Cause(err) == ErrStaleVersion to tell them apart
+var ErrStaleVersion = errors.New("stale version")
+
+// Version enables optimistic concurrency using the given column, it can be an integer
+// version, which is incremented on every update, or a string etag, which is replaced by
+// a random one. Update only changes the row if the version of the provided values is the
+// stored one, a zero version is rejected as errors.Invalid unless UnversionedUpdates is
+// enabled. The version is never written from the provided values
+func Version(column string) Option {
+	return func(op *PartialMutation) {
+		op.versionColumn = column
+	}
+}
+
+// UnversionedUpdates allows updates with a zero version when Version is enabled, they skip
+// the check and overwrite the stored row regardless of its version
+func UnversionedUpdates() Option {
+	return func(op *PartialMutation) {
+		op.unversionedUpdates = true
+	}
+}
+
+// validateVersion checks that the version column is a field with a supported type
+func (p *PartialMutation) validateVersion() error {
+	if p.versionColumn == "" {
+		return nil
+	}
+
+	column, fieldType, ok := p.resolveField(p.versionColumn)
+	if !ok {
+		return errors.E(errors.Errorf("PartialMutation, version column %s is not a field of %s", p.versionColumn, p.structType), errors.Invalid)
+	}
+
+	// the version can be provided as a struct field name too
+	p.versionColumn = column
+
+	switch fieldType.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return nil
+	}
+
+	return errors.E(errors.Errorf("PartialMutation, version column %s must be a string or an integer", p.versionColumn), errors.Invalid)
+}
+
+func (p *PartialMutation) isEtag() bool {
+	_, fieldType, _ := p.resolveField(p.versionColumn)
+	return fieldType.Kind() == reflect.String
+}
+
+// initialVersion returns the version of a new row
+func (p *PartialMutation) initialVersion() (interface{}, error) {
+	if p.isEtag() {
+		return newEtag()
+	}
+
+	return 1, nil
+}
+
+// nextVersion returns the value that replaces the stored version on update
+func (p *PartialMutation) nextVersion() (interface{}, error) {
+	if p.isEtag() {
+		return newEtag()
+	}
+
+	return db.Raw(fmt.Sprintf("%s + 1", quoteIdentifier(p.versionColumn))), nil
+}
+
+// upsertVersion adds the update of the version column to the ON CONFLICT clause
+func (p *PartialMutation) upsertVersion(clause *conflictClause) {
+	if p.isEtag() {
+		clause.excluded = append(clause.excluded, p.versionColumn)
+		return
+	}
+
+	clause.increment = append(clause.increment, p.versionColumn)
+}
+
+// expectedVersion returns the version of the provided values, a zero version is rejected
+// unless unversioned updates are allowed, then it is returned as nil
+func (p *PartialMutation) expectedVersion(structPtr interface{}) (interface{}, error) {
+	mapValues, err := p.fieldValues(structPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	version := mapValues[p.columnsMap[p.versionColumn]]
+	if version != nil && !reflect.DeepEqual(version, reflect.Zero(reflect.TypeOf(version)).Interface()) {
+		return version, nil
+	}
+
+	if !p.unversionedUpdates {
+		return nil, errors.E(errors.Errorf("operation update can not be performed, %s is required", p.versionColumn), errors.Invalid)
+	}
+
+	return nil, nil
+}
+
+// withVersion replaces the version column of an insert with the initial version
+func (p *PartialMutation) withVersion(columns []string, values []interface{}) ([]string, []interface{}, error) {
+	if p.versionColumn == "" {
+		return columns, values, nil
+	}
+
+	version, err := p.initialVersion()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns, values = withoutColumn(columns, values, p.versionColumn)
+	return append(columns, p.versionColumn), append(values, version), nil
+}
+
+// withoutColumn removes a column and its value
+func withoutColumn(columns []string, values []interface{}, column string) ([]string, []interface{}) {
+	var (
+		newColumns []string
+		newValues  []interface{}
+	)
+
+	for i := range columns {
+		if columns[i] == column {
+			continue
+		}
+
+		newColumns = append(newColumns, columns[i])
+		newValues = append(newValues, values[i])
+	}
+
+	return newColumns, newValues
+}
+
+// staleOrNotExist tells apart an update that affected zero rows because the version is
+// stale, from an update over a row that does not exist
+func (p *PartialMutation) staleOrNotExist(ctx context.Context, sess sqlbuilder.SQLBuilder, tenant db.Cond, whereColumn, whereValue string) error {
+	query := sess.Select(db.Raw("1")).From(p.table).Where(whereColumn, whereValue).And(tenant)
+	if p.softDeleteColumn != "" {
+		query = query.And(db.Cond{p.softDeleteColumn: db.IsNull()})
+	}
+
+	iter := query.Limit(1).IteratorContext(ctx)
+	defer iter.Close() // nolint: errcheck
+
+	if iter.Next() {
+		return errors.E(ErrStaleVersion, fmt.Sprintf("operation update can not be performed, resource %s", whereValue), errors.Duplicated)
+	}
+
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return errors.E(errors.Errorf("operation update can not be performed, not exist, resource %s", whereValue), errors.NotExist)
+}
+
+// newEtag returns a random etag
+func newEtag() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.E(err, "newEtag", errors.Internal)
+	}
+
+	return hex.EncodeToString(b), nil
+}
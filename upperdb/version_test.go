@@ -0,0 +1,130 @@
+package upperdb
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mishudark/errors"
+	db "upper.io/db.v3"
+)
+
+type versionedResource struct {
+	Name    string `db:"name"`
+	Version int64  `db:"version"`
+	Etag    string `db:"etag"`
+}
+
+func TestVersionColumns(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(versionedResource{}),
+		Exclude([]string{"Etag"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+		Version("Version"),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &versionedResource{Name: "CAN", Version: 7}
+
+	columns, values, err := mut.insertColumnsValues(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedColumns := []string{"name", "version"}
+	expectedValues := []interface{}{"CAN", 1}
+	if equal := cmp.Equal(expectedColumns, columns) && cmp.Equal(expectedValues, values); !equal {
+		t.Errorf("insert must use the initial version, got %v %v", columns, values)
+	}
+
+	columns, _, err = mut.updateColumnsValues(r, []string{"Name", "Version"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if equal := cmp.Equal([]string{"name"}, columns); !equal {
+		t.Errorf("update must not write the provided version, got %v", columns)
+	}
+
+	expected, err := mut.expectedVersion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected != int64(7) {
+		t.Errorf("expecting version 7, got %v", expected)
+	}
+
+	next, err := mut.nextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if raw, ok := next.(db.RawValue); !ok || raw.Raw() != `"version" + 1` {
+		t.Errorf("expecting the version to be incremented, got %v", next)
+	}
+
+	if _, err := mut.expectedVersion(&versionedResource{Name: "CAN"}); !errors.IsKind(err, errors.Invalid) {
+		t.Errorf("a zero version must be rejected, got %v", err)
+	}
+
+	UnversionedUpdates()(mut)
+	expected, err = mut.expectedVersion(&versionedResource{Name: "CAN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected != nil {
+		t.Errorf("a zero version must skip the check when unversioned updates are allowed, got %v", expected)
+	}
+}
+
+func TestVersionEtag(t *testing.T) {
+	mut, err := NewPartialMutation(
+		Values(versionedResource{}),
+		Include([]string{"Name", "Etag"}),
+		Table("resources"),
+		Session(&databaseMock{}),
+		Version("etag"),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := mut.nextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := mut.nextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second || len(first.(string)) != 32 {
+		t.Errorf("expecting random etags, got %v and %v", first, second)
+	}
+}
+
+func TestVersionInvalid(t *testing.T) {
+	for _, column := range []string{"unknown", "name_length"} {
+		_, err := NewPartialMutation(
+			Values(struct {
+				Name       string  `db:"name"`
+				NameLength float64 `db:"name_length"`
+			}{}),
+			Include([]string{"Name"}),
+			Table("resources"),
+			Session(&databaseMock{}),
+			Version(column),
+		)
+
+		if !errors.IsKind(err, errors.Invalid) {
+			t.Errorf("%s: expecting an invalid error, got %v", column, err)
+		}
+	}
+}